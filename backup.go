@@ -6,6 +6,8 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"log"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -19,19 +21,58 @@ import (
 
 // PathSlug converts a directory path to a slug for S3 keys.
 // e.g. "/opt/homeassistant/config" -> "opt-homeassistant-config"
+// Command source IDs get a fixed prefix: "cmd:system" -> "cmd-system".
 func PathSlug(dir string) string {
+	if name, ok := strings.CutPrefix(dir, commandPrefix); ok {
+		return "cmd-" + name
+	}
 	cleaned := filepath.Clean(dir)
 	cleaned = strings.TrimPrefix(cleaned, "/")
 	return strings.ReplaceAll(cleaned, "/", "-")
 }
 
+// snapshotTimeFormat is the layout of the timestamp in every S3 key.
+const snapshotTimeFormat = "2006-01-02T15-04-05Z"
+
 // S3Key builds the full S3 object key.
 func S3Key(hostname, dir string, t time.Time) string {
 	slug := PathSlug(dir)
-	ts := t.UTC().Format("2006-01-02T15-04-05Z")
+	ts := t.UTC().Format(snapshotTimeFormat)
 	return fmt.Sprintf("%s/%s/%s.tar.gz", hostname, slug, ts)
 }
 
+// SkippedEntry is a file or directory left out of an archive because it
+// couldn't be read and the directory's on_error policy is "skip".
+type SkippedEntry struct {
+	Path string
+	Err  error
+}
+
+// ZeroFilledEntry is a file whose read failed part way through under the
+// "skip" on_error policy. Its header was already in the archive by then,
+// so it is archived with everything after the first Written bytes
+// zero-filled rather than left out.
+type ZeroFilledEntry struct {
+	Path    string
+	Written int64
+	Err     error
+}
+
+// ChangedEntry is a file that was modified while it was being read, so its
+// archived copy may not match any state the file was actually in.
+type ChangedEntry struct {
+	Path   string
+	Detail string
+}
+
+// ArchiveReport describes anything CreateArchive had to work around while
+// building an otherwise successful archive.
+type ArchiveReport struct {
+	Skipped    []SkippedEntry
+	ZeroFilled []ZeroFilledEntry
+	Changed    []ChangedEntry
+}
+
 // CreateArchive creates a tar.gz archive of dir and writes it to w. Paths
 // inside the archive are relative to dir's parent.
 //
@@ -40,17 +81,55 @@ func S3Key(hostname, dir string, t time.Time) string {
 // its bytes are read from the override (used for SQLite snapshots).
 //
 // excludes is a set of absolute paths to skip entirely. Both maps may be nil.
-func CreateArchive(w io.Writer, dir string, overrides map[string]string, excludes map[string]bool) error {
+// opts controls mount point crossing, symlink following, sparse files,
+// whether unreadable entries fail the archive or are skipped and reported,
+// and how files that change while being read are retried.
+func CreateArchive(w io.Writer, dir string, overrides map[string]string, excludes map[string]bool, opts ArchiveOptions) (ArchiveReport, error) {
 	gw := gzip.NewWriter(w)
 	defer gw.Close()
 
 	tw := tar.NewWriter(gw)
 	defer tw.Close()
 
-	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
+	var report ArchiveReport
+	// changed records a file whose archived copy may be inconsistent.
+	changed := func(path, detail string) {
+		log.Printf("warning: %s changed while being archived: %s", path, detail)
+		report.Changed = append(report.Changed, ChangedEntry{Path: path, Detail: detail})
+	}
+	// spool holds stable copies of files when change retries are enabled.
+	var spool *os.File
+	defer func() {
+		if spool != nil {
+			spool.Close()
+			os.Remove(spool.Name())
+		}
+	}()
+	// skip records path as skipped when the policy allows it, and returns
+	// err otherwise. The root itself is never skipped.
+	skip := func(path string, err error) error {
+		if !opts.SkipErrors || path == dir {
+			return err
+		}
+		log.Printf("warning: skipping %s: %v", path, err)
+		report.Skipped = append(report.Skipped, SkippedEntry{Path: path, Err: err})
+		return nil
+	}
+	// zeroFilled records a file whose read failed after its header was
+	// written when the policy allows it, and returns err otherwise.
+	zeroFilled := func(path string, err *entryReadError) error {
+		if !opts.SkipErrors {
 			return err
 		}
+		log.Printf("warning: %s: %v", path, err)
+		report.ZeroFilled = append(report.ZeroFilled, ZeroFilledEntry{Path: path, Written: err.Written, Err: err.Err})
+		return nil
+	}
+
+	err := walkTree(dir, opts, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return skip(path, err)
+		}
 
 		if excludes[path] {
 			if info.IsDir() {
@@ -101,37 +180,140 @@ func CreateArchive(w io.Writer, dir string, overrides map[string]string, exclude
 		if info.Mode()&os.ModeSymlink != 0 {
 			link, err := os.Readlink(path)
 			if err != nil {
-				return err
+				return skip(path, err)
 			}
 			header.Linkname = link
 		}
 
-		if err := tw.WriteHeader(header); err != nil {
-			return err
-		}
-
 		// Only write content for regular files
 		if !info.Mode().IsRegular() {
-			return nil
+			return tw.WriteHeader(header)
 		}
 
+		// Open before writing the header so a file that is unreadable or
+		// has vanished since the walk saw it can still be skipped cleanly.
 		readPath := path
 		if src, ok := overrides[path]; ok {
 			readPath = src
 		}
 		f, err := os.Open(readPath)
 		if err != nil {
-			return err
+			return skip(path, err)
 		}
 		defer f.Close()
 
-		_, err = io.Copy(tw, f)
-		return err
+		// Size the entry from the open file rather than the walk's stat,
+		// and keep that stat to detect changes made while reading.
+		pre, err := f.Stat()
+		if err != nil {
+			return skip(path, err)
+		}
+		header.Size = pre.Size()
+
+		// With change retries, a file is first read through once to see
+		// whether it is being written to. Only one that is gets copied to
+		// the spool and re-read until a copy is consistent; the rest are
+		// archived straight from the file below.
+		var unstable string
+		if opts.ChangeRetries > 0 {
+			if unstable, err = readStable(f); err != nil {
+				return skip(path, err)
+			}
+			if pre, err = f.Stat(); err != nil {
+				return skip(path, err)
+			}
+			header.Size = pre.Size()
+		}
+		// A sparse file that is being written to is spooled like any other,
+		// and archived in full.
+		if opts.Sparse && unstable == "" {
+			if segs, ok := dataSegments(f, header.Size); ok {
+				written, err := writeSparseEntry(tw, gw, header, f, segs)
+				if err != nil {
+					return err
+				}
+				if written {
+					if detail := changedWhileReading(f, pre, header.Size); detail != "" {
+						changed(path, detail+"; archived the data as it was read")
+					}
+					return nil
+				}
+			}
+		}
+
+		if unstable != "" {
+			if spool == nil {
+				if spool, err = os.CreateTemp("", "pi-backup-spool-*"); err != nil {
+					return fmt.Errorf("creating spool file: %w", err)
+				}
+			}
+			time.Sleep(changeRetryDelay)
+			// The first read counts against the retries.
+			attempts, detail, err := spoolStable(f, spool, opts.ChangeRetries-1)
+			if err != nil {
+				return skip(path, err)
+			}
+			attempts++
+			if detail != "" {
+				changed(path, fmt.Sprintf("%s on all %d reads; archived the bytes from the last read", detail, attempts))
+			} else {
+				log.Printf("%s changed while being read; got a consistent copy after %d reads", path, attempts)
+			}
+			header.Size, err = spool.Seek(0, io.SeekEnd)
+			if err != nil {
+				return err
+			}
+			if _, err := spool.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			_, err = io.CopyN(tw, spool, header.Size)
+			return err
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		n, err := copyEntry(tw, f, header.Size)
+		if err != nil {
+			if rerr, ok := err.(*entryReadError); ok {
+				return zeroFilled(path, rerr)
+			}
+			return err
+		}
+		if detail := changedWhileReading(f, pre, n); detail != "" {
+			if n < header.Size {
+				detail += fmt.Sprintf("; entry zero-filled after %d bytes", n)
+			} else {
+				detail += fmt.Sprintf("; archived the first %d bytes", n)
+			}
+			changed(path, detail)
+		}
+		return nil
 	})
+	return report, err
 }
 
-// UploadToS3 uploads data from r to the given S3 bucket and key.
-func UploadToS3(ctx context.Context, region, bucket, key string, r io.Reader) error {
+// hashMetadataKey is the user metadata key under which each archive's
+// SHA-256 hex digest is stored, so state can be rebuilt without
+// downloading archives.
+const hashMetadataKey = "sha256"
+
+// sourceMetadataKey is the user metadata key under which each archive's
+// source (directory path or command source ID) is stored, path-escaped,
+// since slugs can't be turned back into paths.
+const sourceMetadataKey = "source"
+
+// sourceMetadata returns the metadata value recording source.
+func sourceMetadata(source string) string {
+	return (&url.URL{Path: source}).EscapedPath()
+}
+
+// UploadToS3 uploads data from r to the given S3 bucket and key, with
+// metadata as the object's user metadata.
+func UploadToS3(ctx context.Context, region, bucket, key string, r io.Reader, metadata map[string]string) error {
 	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(region))
 	if err != nil {
 		return fmt.Errorf("loading AWS config: %w", err)
@@ -141,9 +323,10 @@ func UploadToS3(ctx context.Context, region, bucket, key string, r io.Reader) er
 	tm := transfermanager.New(client)
 
 	_, err = tm.UploadObject(ctx, &transfermanager.UploadObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-		Body:   r,
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		Body:     r,
+		Metadata: metadata,
 	})
 	if err != nil {
 		return fmt.Errorf("uploading to s3://%s/%s: %w", bucket, key, err)
@@ -151,3 +334,34 @@ func UploadToS3(ctx context.Context, region, bucket, key string, r io.Reader) er
 
 	return nil
 }
+
+// CopyInS3 copies the object at src to dst within bucket, server side,
+// keeping its metadata. Objects over 5 GB can't be copied this way and
+// return an error.
+func CopyInS3(ctx context.Context, region, bucket, src, dst string) error {
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(region))
+	if err != nil {
+		return fmt.Errorf("loading AWS config: %w", err)
+	}
+
+	client := s3.NewFromConfig(cfg)
+	_, err = client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(bucket),
+		Key:        aws.String(dst),
+		CopySource: aws.String(copySource(bucket, src)),
+	})
+	if err != nil {
+		return fmt.Errorf("copying s3://%s/%s to %s: %w", bucket, src, dst, err)
+	}
+	return nil
+}
+
+// copySource URL-encodes bucket and key for CopyObjectInput.CopySource,
+// leaving the slashes between key segments alone.
+func copySource(bucket, key string) string {
+	parts := strings.Split(bucket+"/"+key, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
@@ -52,7 +52,7 @@ func TestCreateArchive(t *testing.T) {
 	os.WriteFile(filepath.Join(subdir, "nested", "file2.txt"), []byte("world"), 0644)
 
 	var buf bytes.Buffer
-	if err := CreateArchive(&buf, subdir, nil, nil); err != nil {
+	if _, err := CreateArchive(&buf, subdir, nil, nil, ArchiveOptions{}); err != nil {
 		t.Fatalf("CreateArchive: %v", err)
 	}
 
@@ -111,14 +111,14 @@ func TestCreateArchiveDeterministic(t *testing.T) {
 	os.WriteFile(filepath.Join(subdir, "sub", "b.txt"), []byte("bbb"), 0644)
 
 	var buf1, buf2 bytes.Buffer
-	if err := CreateArchive(&buf1, subdir, nil, nil); err != nil {
+	if _, err := CreateArchive(&buf1, subdir, nil, nil, ArchiveOptions{}); err != nil {
 		t.Fatalf("first CreateArchive: %v", err)
 	}
 
 	// Small delay so atime/ctime would differ if not zeroed
 	time.Sleep(10 * time.Millisecond)
 
-	if err := CreateArchive(&buf2, subdir, nil, nil); err != nil {
+	if _, err := CreateArchive(&buf2, subdir, nil, nil, ArchiveOptions{}); err != nil {
 		t.Fatalf("second CreateArchive: %v", err)
 	}
 
@@ -126,3 +126,94 @@ func TestCreateArchiveDeterministic(t *testing.T) {
 		t.Error("CreateArchive produced different output for identical files")
 	}
 }
+
+func TestCreateArchiveSkipUnreadable(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permission checks don't apply to root")
+	}
+	dir := t.TempDir()
+	subdir := filepath.Join(dir, "data")
+	os.MkdirAll(filepath.Join(subdir, "locked"), 0755)
+	os.WriteFile(filepath.Join(subdir, "ok.txt"), []byte("ok"), 0644)
+	secret := filepath.Join(subdir, "secret.txt")
+	os.WriteFile(secret, []byte("secret"), 0000)
+	os.Chmod(filepath.Join(subdir, "locked"), 0000)
+	defer os.Chmod(filepath.Join(subdir, "locked"), 0755)
+
+	var buf bytes.Buffer
+	if _, err := CreateArchive(&buf, subdir, nil, nil, ArchiveOptions{}); err == nil {
+		t.Fatal("expected error with on_error: fail")
+	}
+
+	buf.Reset()
+	report, err := CreateArchive(&buf, subdir, nil, nil, ArchiveOptions{SkipErrors: true})
+	if err != nil {
+		t.Fatalf("CreateArchive: %v", err)
+	}
+	skipped := map[string]bool{}
+	for _, e := range report.Skipped {
+		skipped[e.Path] = true
+	}
+	if !skipped[secret] || !skipped[filepath.Join(subdir, "locked")] {
+		t.Errorf("Skipped = %v, want secret.txt and locked/", report.Skipped)
+	}
+
+	gr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	tr := tar.NewReader(gr)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tar: %v", err)
+		}
+		names = append(names, hdr.Name)
+	}
+	for _, n := range names {
+		if n == "data/secret.txt" {
+			t.Error("unreadable file should not be in the archive")
+		}
+	}
+}
+
+func TestCreateArchiveChangeRetriesSameOutput(t *testing.T) {
+	dir := t.TempDir()
+	subdir := filepath.Join(dir, "data")
+	os.MkdirAll(filepath.Join(subdir, "sub"), 0755)
+	os.WriteFile(filepath.Join(subdir, "a.txt"), []byte("aaa"), 0644)
+	os.WriteFile(filepath.Join(subdir, "sub", "b.txt"), bytes.Repeat([]byte("b"), 100000), 0644)
+
+	var direct, spooled bytes.Buffer
+	if _, err := CreateArchive(&direct, subdir, nil, nil, ArchiveOptions{}); err != nil {
+		t.Fatalf("CreateArchive: %v", err)
+	}
+	report, err := CreateArchive(&spooled, subdir, nil, nil, ArchiveOptions{ChangeRetries: 2})
+	if err != nil {
+		t.Fatalf("CreateArchive with retries: %v", err)
+	}
+	if len(report.Changed) != 0 {
+		t.Errorf("Changed = %v, want none", report.Changed)
+	}
+	if !bytes.Equal(direct.Bytes(), spooled.Bytes()) {
+		t.Error("spooled archive differs from streamed archive for unchanging files")
+	}
+}
+
+func TestCreateArchiveChangeRetriesStreamsStableFiles(t *testing.T) {
+	subdir := filepath.Join(t.TempDir(), "data")
+	os.MkdirAll(subdir, 0755)
+	os.WriteFile(filepath.Join(subdir, "a.txt"), []byte("aaa"), 0644)
+
+	// With nowhere to create a spool file, archiving only succeeds if
+	// stable files aren't spooled.
+	t.Setenv("TMPDIR", filepath.Join(t.TempDir(), "missing"))
+	var buf bytes.Buffer
+	if _, err := CreateArchive(&buf, subdir, nil, nil, ArchiveOptions{ChangeRetries: 2}); err != nil {
+		t.Fatalf("CreateArchive: %v", err)
+	}
+}
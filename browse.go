@@ -0,0 +1,195 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strconv"
+)
+
+// errStopWalk is returned by a WalkArchive callback to stop reading the
+// archive early without an error.
+var errStopWalk = errors.New("stop walking archive")
+
+// WalkArchive calls fn with the header and contents of each entry of the
+// tar.gz archive read from r, stopping at the first error fn returns.
+func WalkArchive(r io.Reader, fn func(hdr *tar.Header, r io.Reader) error) error {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("opening gzip: %w", err)
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading tar: %w", err)
+		}
+		if err := fn(hdr, tr); err == errStopWalk {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// StreamBackup downloads the archive at key and pipes it into consume,
+// without a local copy. If consume returns before reading everything, the
+// rest of the download is abandoned. A failed download reaches consume as
+// a read error, so consume's error is the result.
+func StreamBackup(ctx context.Context, cfg *Config, key string, consume func(r io.Reader) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(DownloadFromS3(ctx, cfg.Region, cfg.Bucket, key, pw))
+	}()
+
+	err := consume(pr)
+	cancel()
+	pr.Close()
+	<-done
+	return err
+}
+
+// ListArchive writes a long listing (mode, owner, size, mtime, name) of
+// the entries of the tar.gz archive read from r to w. With prefix set only
+// entries it matches are listed (see matchPattern).
+func ListArchive(r io.Reader, prefix string, w io.Writer) error {
+	found := false
+	err := WalkArchive(r, func(hdr *tar.Header, _ io.Reader) error {
+		if prefix != "" && !matchPattern(prefix, hdr.Name) {
+			return nil
+		}
+		found = true
+		_, err := fmt.Fprintln(w, formatEntry(hdr))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if prefix != "" && !found {
+		return fmt.Errorf("nothing matches %q in the archive", prefix)
+	}
+	return nil
+}
+
+// formatEntry formats hdr like a line of `tar -tv`.
+func formatEntry(hdr *tar.Header) string {
+	owner := hdr.Uname
+	if owner == "" {
+		owner = strconv.Itoa(hdr.Uid)
+	}
+	group := hdr.Gname
+	if group == "" {
+		group = strconv.Itoa(hdr.Gid)
+	}
+	line := fmt.Sprintf("%s %s/%s %10d %s %s",
+		hdr.FileInfo().Mode(), owner, group, hdr.Size, hdr.ModTime.UTC().Format("2006-01-02 15:04"), hdr.Name)
+	if hdr.Typeflag == tar.TypeSymlink {
+		line += " -> " + hdr.Linkname
+	}
+	return line
+}
+
+// CatArchive writes the contents of the regular file name in the tar.gz
+// archive read from r to w, and stops reading once it has.
+func CatArchive(r io.Reader, name string, w io.Writer) error {
+	name = path.Clean(name)
+	found := false
+	err := WalkArchive(r, func(hdr *tar.Header, r io.Reader) error {
+		if path.Clean(hdr.Name) != name {
+			return nil
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return fmt.Errorf("%s is not a regular file", name)
+		}
+		found = true
+		if _, err := io.Copy(w, r); err != nil {
+			return err
+		}
+		return errStopWalk
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("file %q not found in archive", name)
+	}
+	return nil
+}
+
+// parseInterspersed parses args with fs, allowing flags after positional
+// arguments, and returns the positional ones.
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// runBrowse handles "restore ls" and "restore cat", which read a snapshot
+// without writing anything to disk.
+func runBrowse(cfg *Config, cmd string, args []string) {
+	fs := flag.NewFlagSet("restore "+cmd, flag.ExitOnError)
+	snapshot := fs.String("snapshot", "", "read this snapshot instead of the latest (see restore --snapshot)")
+	at := fs.String("at", "", "read the newest snapshot taken at or before this local time")
+	fromHost := addFromHostFlag(fs, cfg)
+	positional := parseInterspersed(fs, args)
+
+	var dir, name string
+	switch {
+	case cmd == "ls" && (len(positional) == 1 || len(positional) == 2):
+		dir = positional[0]
+		if len(positional) == 2 {
+			name = positional[1]
+		}
+	case cmd == "cat" && len(positional) == 2:
+		dir, name = positional[0], positional[1]
+	default:
+		fmt.Fprintf(os.Stderr, "Usage: pi-backup restore ls <directory> [--snapshot <TS>|--at <time>] [--from-host <name>] [<path>]\n")
+		fmt.Fprintf(os.Stderr, "       pi-backup restore cat <directory> [--snapshot <TS>|--at <time>] [--from-host <name>] <path>\n")
+		os.Exit(1)
+	}
+	if *snapshot != "" && *at != "" {
+		log.Fatal("error: --snapshot and --at can't be combined")
+	}
+
+	ctx := context.Background()
+	key, err := FindSnapshot(ctx, cfg, *fromHost, dir, *snapshot, *at)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	// Progress goes to stderr, so stdout is just the listing or the file.
+	log.Printf("reading s3://%s/%s", cfg.Bucket, key)
+
+	err = StreamBackup(ctx, cfg, key, func(r io.Reader) error {
+		if cmd == "ls" {
+			return ListArchive(r, name, os.Stdout)
+		}
+		return CatArchive(r, name, os.Stdout)
+	})
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// browseArchive returns a tar.gz of a small tree named "data".
+func browseArchive(t *testing.T) []byte {
+	t.Helper()
+	dataDir := filepath.Join(t.TempDir(), "data")
+	os.MkdirAll(filepath.Join(dataDir, "config"), 0755)
+	os.WriteFile(filepath.Join(dataDir, "config", "configuration.yaml"), []byte("homeassistant:\n"), 0640)
+	os.WriteFile(filepath.Join(dataDir, "notes.txt"), []byte("hello"), 0644)
+	os.Symlink("config/configuration.yaml", filepath.Join(dataDir, "link"))
+	mtime := time.Date(2026, 2, 11, 3, 0, 0, 0, time.UTC)
+	os.Chtimes(filepath.Join(dataDir, "notes.txt"), mtime, mtime)
+
+	var buf bytes.Buffer
+	if _, err := CreateArchive(&buf, dataDir, nil, nil, ArchiveOptions{}); err != nil {
+		t.Fatalf("CreateArchive: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestListArchive(t *testing.T) {
+	archive := browseArchive(t)
+
+	var out bytes.Buffer
+	if err := ListArchive(bytes.NewReader(archive), "", &out); err != nil {
+		t.Fatalf("ListArchive: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("got %d lines, want 5:\n%s", len(lines), out.String())
+	}
+	var notes, link string
+	for _, l := range lines {
+		switch {
+		case strings.HasSuffix(l, " data/notes.txt"):
+			notes = l
+		case strings.Contains(l, " data/link"):
+			link = l
+		}
+	}
+	if !strings.HasPrefix(notes, "-rw-r--r-- ") || !strings.Contains(notes, "          5 2026-02-11 03:00 data/notes.txt") {
+		t.Errorf("notes.txt line = %q", notes)
+	}
+	if !strings.HasPrefix(link, "L") || !strings.HasSuffix(link, "data/link -> config/configuration.yaml") {
+		t.Errorf("link line = %q", link)
+	}
+
+	out.Reset()
+	if err := ListArchive(bytes.NewReader(archive), "data/config", &out); err != nil {
+		t.Fatalf("ListArchive with prefix: %v", err)
+	}
+	if got := strings.Count(out.String(), "\n"); got != 2 {
+		t.Errorf("prefix listing has %d lines, want 2 (the directory and its file):\n%s", got, out.String())
+	}
+
+	if err := ListArchive(bytes.NewReader(archive), "data/nope", &out); err == nil {
+		t.Error("want error for a prefix that matches nothing")
+	}
+}
+
+func TestCatArchive(t *testing.T) {
+	archive := browseArchive(t)
+
+	var out bytes.Buffer
+	if err := CatArchive(bytes.NewReader(archive), "data/config/configuration.yaml", &out); err != nil {
+		t.Fatalf("CatArchive: %v", err)
+	}
+	if out.String() != "homeassistant:\n" {
+		t.Errorf("CatArchive = %q", out.String())
+	}
+
+	for _, name := range []string{"data/missing.yaml", "data/config", "data/link"} {
+		if err := CatArchive(bytes.NewReader(archive), name, &out); err == nil {
+			t.Errorf("CatArchive(%s): want error", name)
+		}
+	}
+}
+
+func TestParseInterspersed(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	snapshot := fs.String("snapshot", "", "")
+	got := parseInterspersed(fs, []string{"/opt/data", "--snapshot", "previous", "data/config"})
+	if *snapshot != "previous" || strings.Join(got, " ") != "/opt/data data/config" {
+		t.Errorf("positional = %v, snapshot = %q", got, *snapshot)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// commandPrefix marks a source ID as a command source rather than a
+// directory path, e.g. "cmd:system-state".
+const commandPrefix = "cmd:"
+
+// defaultCommandTimeout bounds commands that don't set their own timeout.
+const defaultCommandTimeout = 5 * time.Minute
+
+// commandFileTime is the mtime given to every captured file, so an archive
+// of unchanged output is byte-identical from run to run.
+var commandFileTime = time.Unix(0, 0)
+
+// CommandSource is a virtual directory whose files are the stdout of
+// commands run at backup time, e.g. `crontab -l` or `dpkg --get-selections`.
+type CommandSource struct {
+	Name  string        `yaml:"name"`
+	Files []CommandFile `yaml:"files"`
+}
+
+// CommandFile is one captured command and where its output goes inside the
+// source's archive.
+type CommandFile struct {
+	Path    string        `yaml:"path"`
+	Command string        `yaml:"command"`
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// ID is the name the source goes by on the command line, e.g. for restore.
+// Its slug (see PathSlug) is "cmd-<name>".
+func (c CommandSource) ID() string {
+	return commandPrefix + c.Name
+}
+
+// validate checks c, which is cfg.Commands[i].
+func (c CommandSource) validate(i int) error {
+	if c.Name == "" {
+		return fmt.Errorf("config: commands[%d].name is required", i)
+	}
+	if strings.ContainsAny(c.Name, "/:") || c.Name == "." || c.Name == ".." {
+		return fmt.Errorf("config: commands[%d].name %q must be a plain name", i, c.Name)
+	}
+	if len(c.Files) == 0 {
+		return fmt.Errorf("config: commands[%d].files: at least one file is required", i)
+	}
+	seen := map[string]bool{}
+	for j, f := range c.Files {
+		if err := validateRelative(f.Path); err != nil {
+			return fmt.Errorf("config: commands[%d].files[%d].path: %w", i, j, err)
+		}
+		if filepath.Clean(f.Path) == "." {
+			return fmt.Errorf("config: commands[%d].files[%d].path must name a file", i, j)
+		}
+		if seen[filepath.Clean(f.Path)] {
+			return fmt.Errorf("config: commands[%d].files[%d].path %q is duplicated", i, j, f.Path)
+		}
+		seen[filepath.Clean(f.Path)] = true
+		if strings.TrimSpace(f.Command) == "" {
+			return fmt.Errorf("config: commands[%d].files[%d].command is required", i, j)
+		}
+		if f.Timeout < 0 {
+			return fmt.Errorf("config: commands[%d].files[%d].timeout must not be negative", i, j)
+		}
+	}
+	return nil
+}
+
+// createCommandArchiveWithHash runs every command in c and archives their
+// output as files under a top-level "<name>/" directory. Like
+// createArchiveWithHash it returns the temp archive path and its SHA-256.
+//
+// The archive is built from a staging tree of empty placeholder files with
+// fixed metadata, with each command's captured stdout spliced in through
+// CreateArchive's overrides, the same way SQLite snapshots are. Identical
+// output therefore gives an identical archive and is skipped as unchanged.
+func createCommandArchiveWithHash(ctx context.Context, c CommandSource) (path string, hash string, report ArchiveReport, err error) {
+	stage, err := os.MkdirTemp("", "pi-backup-cmd-*")
+	if err != nil {
+		return "", "", report, fmt.Errorf("creating staging dir: %w", err)
+	}
+	defer os.RemoveAll(stage)
+
+	root := filepath.Join(stage, c.Name)
+	outDir := filepath.Join(stage, ".output")
+	if err := os.MkdirAll(outDir, 0700); err != nil {
+		return "", "", report, fmt.Errorf("creating staging dir: %w", err)
+	}
+
+	overrides := map[string]string{}
+	for i, f := range c.Files {
+		placeholder := filepath.Join(root, filepath.Clean(f.Path))
+		if err := os.MkdirAll(filepath.Dir(placeholder), 0755); err != nil {
+			return "", "", report, fmt.Errorf("creating staging dir: %w", err)
+		}
+		if err := os.WriteFile(placeholder, nil, 0644); err != nil {
+			return "", "", report, fmt.Errorf("creating placeholder: %w", err)
+		}
+
+		out := filepath.Join(outDir, fmt.Sprint(i))
+		if err := captureCommand(ctx, f, out); err != nil {
+			return "", "", report, fmt.Errorf("%s: %w", f.Path, err)
+		}
+		overrides[placeholder] = out
+	}
+
+	// Pin the staging tree's metadata so only command output affects the
+	// archive.
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		mode := os.FileMode(0644)
+		if info.IsDir() {
+			mode = 0755
+		}
+		if err := os.Chmod(p, mode); err != nil {
+			return err
+		}
+		return os.Chtimes(p, commandFileTime, commandFileTime)
+	})
+	if err != nil {
+		return "", "", report, fmt.Errorf("preparing staging dir: %w", err)
+	}
+
+	return archiveToTemp(root, overrides, nil, ArchiveOptions{})
+}
+
+// captureCommand runs f.Command through /bin/sh and writes its stdout to
+// out. Stderr is logged. A non-zero exit status is an error.
+func captureCommand(ctx context.Context, f CommandFile, out string) error {
+	timeout := f.Timeout
+	if timeout == 0 {
+		timeout = defaultCommandTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	w, err := os.Create(out)
+	if err != nil {
+		return fmt.Errorf("creating output file: %w", err)
+	}
+	defer w.Close()
+
+	var stderr strings.Builder
+	cmd := shellCommand(ctx, f.Command)
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	for _, line := range strings.Split(strings.TrimRight(stderr.String(), "\n"), "\n") {
+		if line != "" {
+			log.Printf("  [%s] %s", f.Path, line)
+		}
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("command %q timed out after %s", f.Command, timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("command %q: %w", f.Command, err)
+	}
+	return w.Close()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCommandSourceSlug(t *testing.T) {
+	c := CommandSource{Name: "system-state"}
+	if got, want := c.ID(), "cmd:system-state"; got != want {
+		t.Errorf("ID() = %q, want %q", got, want)
+	}
+	if got, want := PathSlug(c.ID()), "cmd-system-state"; got != want {
+		t.Errorf("PathSlug(%q) = %q, want %q", c.ID(), got, want)
+	}
+}
+
+func TestCreateCommandArchive(t *testing.T) {
+	c := CommandSource{
+		Name: "system",
+		Files: []CommandFile{
+			{Path: "greeting.txt", Command: "echo hello; echo ignored >&2"},
+			{Path: "nested/list.txt", Command: "printf 'a\\nb\\n'"},
+		},
+	}
+	ctx := context.Background()
+
+	path1, hash1, _, err := createCommandArchiveWithHash(ctx, c)
+	if err != nil {
+		t.Fatalf("createCommandArchiveWithHash: %v", err)
+	}
+	defer os.Remove(path1)
+
+	// Same output must give the same archive so skip-unchanged works.
+	path2, hash2, _, err := createCommandArchiveWithHash(ctx, c)
+	if err != nil {
+		t.Fatalf("second createCommandArchiveWithHash: %v", err)
+	}
+	os.Remove(path2)
+	if hash1 != hash2 {
+		t.Error("identical command output produced different archives")
+	}
+
+	// And the archive restores like any other.
+	f, err := os.Open(path1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	dest := t.TempDir()
+	if err := ExtractArchive(f, dest, ExtractOptions{}); err != nil {
+		t.Fatalf("ExtractArchive: %v", err)
+	}
+	for name, want := range map[string]string{
+		"system/greeting.txt":    "hello\n",
+		"system/nested/list.txt": "a\nb\n",
+	} {
+		got, err := os.ReadFile(filepath.Join(dest, name))
+		if err != nil {
+			t.Errorf("reading %s: %v", name, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	c.Files[0].Command = "echo changed"
+	path3, hash3, _, err := createCommandArchiveWithHash(ctx, c)
+	if err != nil {
+		t.Fatalf("third createCommandArchiveWithHash: %v", err)
+	}
+	os.Remove(path3)
+	if hash3 == hash1 {
+		t.Error("changed command output produced the same archive")
+	}
+}
+
+func TestCreateCommandArchiveFailingCommand(t *testing.T) {
+	c := CommandSource{
+		Name:  "broken",
+		Files: []CommandFile{{Path: "out.txt", Command: "echo partial; exit 3"}},
+	}
+	path, _, _, err := createCommandArchiveWithHash(context.Background(), c)
+	if err == nil {
+		os.Remove(path)
+		t.Fatal("expected error for failing command")
+	}
+}
@@ -5,21 +5,56 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Directory struct {
-	Path        string   `yaml:"path"`
-	SqliteFiles []string `yaml:"sqlite_files,omitempty"`
-	Excludes    []string `yaml:"excludes,omitempty"`
+	Path             string         `yaml:"path"`
+	SqliteFiles      []string       `yaml:"sqlite_files,omitempty"`
+	SqliteAutodetect bool           `yaml:"sqlite_autodetect,omitempty"`
+	Excludes         []string       `yaml:"excludes,omitempty"`
+	OneFileSystem    bool           `yaml:"one_file_system,omitempty"`
+	FollowSymlinks   bool           `yaml:"follow_symlinks,omitempty"`
+	Sparse           bool           `yaml:"sparse,omitempty"`
+	OnError          string         `yaml:"on_error,omitempty"` // "fail" (default) or "skip"
+	ChangeRetries    int            `yaml:"change_retries,omitempty"`
+	Hooks            Hooks          `yaml:"hooks,omitempty"`
+	Docker           *DockerOptions `yaml:"docker,omitempty"`
+	Retention        *Retention     `yaml:"retention,omitempty"`
+	MaxSnapshotAge   time.Duration  `yaml:"max_snapshot_age,omitempty"`
 }
 
+// ArchiveOptions returns the walk options CreateArchive should use for d.
+func (d Directory) ArchiveOptions() ArchiveOptions {
+	return ArchiveOptions{
+		OneFileSystem:  d.OneFileSystem,
+		FollowSymlinks: d.FollowSymlinks,
+		Sparse:         d.Sparse,
+		SkipErrors:     d.OnError == OnErrorSkip,
+		ChangeRetries:  d.ChangeRetries,
+	}
+}
+
+// on_error policies for unreadable entries inside a directory.
+const (
+	OnErrorFail = "fail"
+	OnErrorSkip = "skip"
+)
+
 type Config struct {
-	Hostname    string      `yaml:"hostname"`
-	Bucket      string      `yaml:"bucket"`
-	Region      string      `yaml:"region"`
-	Directories []Directory `yaml:"directories"`
+	Hostname          string          `yaml:"hostname"`
+	Bucket            string          `yaml:"bucket"`
+	Region            string          `yaml:"region"`
+	Directories       []Directory     `yaml:"directories"`
+	Commands          []CommandSource `yaml:"commands,omitempty"`
+	Hooks             Hooks           `yaml:"hooks,omitempty"`
+	Retention         *Retention      `yaml:"retention,omitempty"`
+	VerifyRemote      bool            `yaml:"verify_remote,omitempty"`       // check recorded uploads still exist before skipping unchanged sources
+	MaxSnapshotAge    time.Duration   `yaml:"max_snapshot_age,omitempty"`    // refresh unchanged sources whose latest upload is older than this
+	DeepCheckInterval time.Duration   `yaml:"deep_check_interval,omitempty"` // archive in full at least this often despite a matching fingerprint; default 7 days
+	RestoreLimits     RestoreLimits   `yaml:"restore_limits,omitempty"`      // bounds on what one restore extracts
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -42,13 +77,54 @@ func LoadConfig(path string) (*Config, error) {
 	if cfg.Region == "" {
 		return nil, fmt.Errorf("config: region is required")
 	}
-	if len(cfg.Directories) == 0 {
-		return nil, fmt.Errorf("config: at least one directory is required")
+	if len(cfg.Directories) == 0 && len(cfg.Commands) == 0 {
+		return nil, fmt.Errorf("config: at least one directory or command is required")
+	}
+	if err := cfg.Hooks.validate("hooks"); err != nil {
+		return nil, err
+	}
+	if err := cfg.RestoreLimits.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.DeepCheckInterval < 0 {
+		return nil, fmt.Errorf("config: deep_check_interval must not be negative")
+	}
+	if cfg.MaxSnapshotAge < 0 {
+		return nil, fmt.Errorf("config: max_snapshot_age must not be negative")
+	}
+	if cfg.Retention != nil {
+		if err := cfg.Retention.validate("retention"); err != nil {
+			return nil, err
+		}
 	}
 	for i, d := range cfg.Directories {
 		if d.Path == "" {
 			return nil, fmt.Errorf("config: directories[%d].path is required", i)
 		}
+		switch d.OnError {
+		case "", OnErrorFail, OnErrorSkip:
+		default:
+			return nil, fmt.Errorf("config: directories[%d].on_error: must be %q or %q, got %q", i, OnErrorFail, OnErrorSkip, d.OnError)
+		}
+		if err := d.Hooks.validate(fmt.Sprintf("directories[%d].hooks", i)); err != nil {
+			return nil, err
+		}
+		if d.ChangeRetries < 0 {
+			return nil, fmt.Errorf("config: directories[%d].change_retries must not be negative", i)
+		}
+		if d.MaxSnapshotAge < 0 {
+			return nil, fmt.Errorf("config: directories[%d].max_snapshot_age must not be negative", i)
+		}
+		if d.Docker != nil {
+			if err := d.Docker.validate(fmt.Sprintf("directories[%d].docker", i)); err != nil {
+				return nil, err
+			}
+		}
+		if d.Retention != nil {
+			if err := d.Retention.validate(fmt.Sprintf("directories[%d].retention", i)); err != nil {
+				return nil, err
+			}
+		}
 		for _, rel := range d.SqliteFiles {
 			if err := validateRelative(rel); err != nil {
 				return nil, fmt.Errorf("config: directories[%d].sqlite_files: %w", i, err)
@@ -61,9 +137,54 @@ func LoadConfig(path string) (*Config, error) {
 		}
 	}
 
+	names := map[string]bool{}
+	for i, c := range cfg.Commands {
+		if err := c.validate(i); err != nil {
+			return nil, err
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("config: commands[%d].name %q is duplicated", i, c.Name)
+		}
+		names[c.Name] = true
+	}
+
+	// Sources with the same slug would share their keys, state and
+	// snapshot listings, and could skip or prune each other's backups.
+	slugs := map[string]string{}
+	for _, id := range cfg.SourceIDs() {
+		slug := PathSlug(id)
+		if other, ok := slugs[slug]; ok {
+			return nil, fmt.Errorf("config: %s and %s are both backed up as %q; rename or move one of them", other, id, slug)
+		}
+		slugs[slug] = id
+	}
+
 	return &cfg, nil
 }
 
+// FindDirectory returns the configured directory whose path is path.
+func (c *Config) FindDirectory(path string) (Directory, bool) {
+	for _, d := range c.Directories {
+		if filepath.Clean(d.Path) == filepath.Clean(path) {
+			return d, true
+		}
+	}
+	return Directory{}, false
+}
+
+// SourceIDs returns the ID of every backup source in c: directory paths,
+// then command source IDs.
+func (c *Config) SourceIDs() []string {
+	var ids []string
+	for _, d := range c.Directories {
+		ids = append(ids, d.Path)
+	}
+	for _, cs := range c.Commands {
+		ids = append(ids, cs.ID())
+	}
+	return ids
+}
+
 // validateRelative ensures p is a relative path that doesn't escape via "..".
 func validateRelative(p string) error {
 	if p == "" {
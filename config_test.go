@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -58,6 +59,70 @@ directories:
 	}
 }
 
+func TestLoadConfigHooks(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	os.WriteFile(path, []byte(`hostname: cherry
+bucket: b
+region: r
+hooks:
+  pre_backup:
+    - command: echo start
+directories:
+  - path: /opt/homeassistant/config
+    hooks:
+      pre_backup:
+        - command: docker compose stop
+          timeout: 2m
+      post_backup:
+        - command: docker compose start
+          on_failure: continue
+`), 0644)
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if len(cfg.Hooks.PreBackup) != 1 || cfg.Hooks.PreBackup[0].Command != "echo start" {
+		t.Errorf("Hooks.PreBackup = %+v", cfg.Hooks.PreBackup)
+	}
+	dh := cfg.Directories[0].Hooks
+	if len(dh.PreBackup) != 1 || dh.PreBackup[0].Timeout != 2*time.Minute {
+		t.Errorf("directory PreBackup = %+v, want 2m timeout", dh.PreBackup)
+	}
+	if len(dh.PostBackup) != 1 || dh.PostBackup[0].OnFailure != HookContinue {
+		t.Errorf("directory PostBackup = %+v", dh.PostBackup)
+	}
+}
+
+func TestLoadConfigCommandsOnly(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	os.WriteFile(path, []byte(`hostname: cherry
+bucket: b
+region: r
+commands:
+  - name: system-state
+    files:
+      - path: crontab.txt
+        command: crontab -l || true
+      - path: dpkg-selections.txt
+        command: dpkg --get-selections
+        timeout: 1m
+`), 0644)
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if len(cfg.Commands) != 1 || len(cfg.Commands[0].Files) != 2 {
+		t.Fatalf("Commands = %+v", cfg.Commands)
+	}
+	if got := cfg.Commands[0].Files[1].Timeout; got != time.Minute {
+		t.Errorf("Files[1].Timeout = %v, want 1m", got)
+	}
+}
+
 func TestLoadConfigMissingFile(t *testing.T) {
 	_, err := LoadConfig("/nonexistent/config.yaml")
 	if err == nil {
@@ -76,7 +141,22 @@ func TestLoadConfigMissingFields(t *testing.T) {
 		{"missing directories", "hostname: h\nbucket: b\nregion: r\n"},
 		{"missing directory path", "hostname: h\nbucket: b\nregion: r\ndirectories:\n  - sqlite_files: [x.db]\n"},
 		{"absolute sqlite path", "hostname: h\nbucket: b\nregion: r\ndirectories:\n  - path: /d\n    sqlite_files: [/x.db]\n"},
+		{"unknown on_error", "hostname: h\nbucket: b\nregion: r\ndirectories:\n  - path: /d\n    on_error: ignore\n"},
+		{"hook without command", "hostname: h\nbucket: b\nregion: r\nhooks:\n  pre_backup:\n    - timeout: 1m\ndirectories:\n  - path: /d\n"},
+		{"unknown hook on_failure", "hostname: h\nbucket: b\nregion: r\ndirectories:\n  - path: /d\n    hooks:\n      post_backup:\n        - command: 'true'\n          on_failure: retry\n"},
+		{"command without name", "hostname: h\nbucket: b\nregion: r\ncommands:\n  - files:\n      - {path: a.txt, command: 'true'}\n"},
+		{"command name with slash", "hostname: h\nbucket: b\nregion: r\ncommands:\n  - name: a/b\n    files:\n      - {path: a.txt, command: 'true'}\n"},
+		{"command escaping path", "hostname: h\nbucket: b\nregion: r\ncommands:\n  - name: sys\n    files:\n      - {path: ../a.txt, command: 'true'}\n"},
+		{"duplicate command names", "hostname: h\nbucket: b\nregion: r\ncommands:\n  - name: sys\n    files:\n      - {path: a.txt, command: 'true'}\n  - name: sys\n    files:\n      - {path: b.txt, command: 'true'}\n"},
+		{"command and directory with the same slug", "hostname: h\nbucket: b\nregion: r\ndirectories:\n  - path: /cmd/sys\ncommands:\n  - name: sys\n    files:\n      - {path: a.txt, command: 'true'}\n"},
+		{"directories with the same slug", "hostname: h\nbucket: b\nregion: r\ndirectories:\n  - path: /opt/a-b\n  - path: /opt/a/b\n"},
+		{"docker without containers", "hostname: h\nbucket: b\nregion: r\ndirectories:\n  - path: /d\n    docker:\n      action: pause\n"},
+		{"unknown docker action", "hostname: h\nbucket: b\nregion: r\ndirectories:\n  - path: /d\n    docker:\n      containers: [app]\n      action: kill\n"},
+		{"empty retention", "hostname: h\nbucket: b\nregion: r\nretention: {}\ndirectories:\n  - path: /d\n"},
+		{"negative retention", "hostname: h\nbucket: b\nregion: r\ndirectories:\n  - path: /d\n    retention:\n      keep_daily: -1\n"},
 		{"escaping exclude", "hostname: h\nbucket: b\nregion: r\ndirectories:\n  - path: /d\n    excludes: [../x]\n"},
+		{"negative restore max_entries", "hostname: h\nbucket: b\nregion: r\nrestore_limits:\n  max_entries: -1\ndirectories:\n  - path: /d\n"},
+		{"bad restore max_size", "hostname: h\nbucket: b\nregion: r\nrestore_limits:\n  max_size: lots\ndirectories:\n  - path: /d\n"},
 	}
 
 	for _, tt := range tests {
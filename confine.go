@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// rootedDest is the destination of an extraction. Files are created
+// through an os.Root, which refuses any path that resolves outside it,
+// and every directory on the way to an entry is checked to be a real
+// directory, so a symlink (from the archive or already on disk) can never
+// redirect a write elsewhere.
+type rootedDest struct {
+	dir  string
+	root *os.Root
+}
+
+// openRootedDest opens dir, creating it unless dryRun, as the root of an
+// extraction. With dryRun and no dir, it returns a rootedDest that only
+// checks paths.
+func openRootedDest(dir string, dryRun bool) (*rootedDest, error) {
+	if !dryRun {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("creating %s: %w", dir, err)
+		}
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil && !(dryRun && os.IsNotExist(err)) {
+		return nil, err
+	}
+	return &rootedDest{dir: dir, root: root}, nil
+}
+
+func (d *rootedDest) Close() {
+	if d.root != nil {
+		d.root.Close()
+	}
+}
+
+// path returns the path of rel below the destination.
+func (d *rootedDest) path(rel string) string {
+	return filepath.Join(d.dir, rel)
+}
+
+// checkRel rejects entry names that aren't a plain relative path below
+// the destination.
+func checkRel(rel string) error {
+	clean := filepath.Clean(rel)
+	if rel == "" || filepath.IsAbs(rel) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("invalid path in archive: %s", rel)
+	}
+	return nil
+}
+
+// parents makes sure every directory above rel is a real directory inside
+// the destination, creating missing ones (mode 0755) unless create is
+// false. It fails on a symlink or anything else that isn't a directory.
+func (d *rootedDest) parents(rel string, create bool) error {
+	parts := strings.Split(filepath.Clean(rel), string(os.PathSeparator))
+	for i := 1; i < len(parts); i++ {
+		p := filepath.Join(parts[:i]...)
+		if d.root == nil {
+			return nil // dry run into a destination that doesn't exist
+		}
+		fi, err := d.root.Lstat(p)
+		if os.IsNotExist(err) {
+			if !create {
+				return nil // nor will anything below it
+			}
+			if err := d.root.Mkdir(p, 0755); err != nil {
+				return fmt.Errorf("creating directory %s: %w", d.path(p), err)
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to restore %s through symlink %s", rel, d.path(p))
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("can't restore %s: %s is not a directory", rel, d.path(p))
+		}
+	}
+	return nil
+}
+
+// mkdir creates the directory rel, whose parents exist, unless it already
+// does.
+func (d *rootedDest) mkdir(rel string, mode os.FileMode) error {
+	err := d.root.Mkdir(rel, mode&os.ModePerm)
+	if os.IsExist(err) {
+		if fi, lerr := d.root.Lstat(rel); lerr == nil && fi.IsDir() {
+			return nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("creating directory %s: %w", d.path(rel), err)
+	}
+	if mode&^os.ModePerm == 0 {
+		return nil
+	}
+	// os.Root only creates plain permissions; add the sticky or set-ID
+	// bits through a handle on the new directory.
+	f, err := d.root.Open(rel)
+	if err == nil {
+		err = f.Chmod(mode)
+		f.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("setting mode of %s: %w", d.path(rel), err)
+	}
+	return nil
+}
+
+// create creates the regular file rel, which must not exist: anything in
+// the way has already been dealt with by the conflict policy, so whatever
+// is there now, a symlink included, is not written to. Only the plain
+// permissions of mode are applied; the caller sets any others once the
+// file is written, since writing clears the set-ID bits.
+func (d *rootedDest) create(rel string, mode os.FileMode) (*os.File, error) {
+	f, err := d.root.OpenFile(rel, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode&os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("creating file %s: %w", d.path(rel), err)
+	}
+	return f, nil
+}
+
+// symlink creates the symlink rel pointing at target. Its parents have
+// been checked by parents, and the link is created, never followed.
+func (d *rootedDest) symlink(rel, target string) error {
+	if err := os.Symlink(target, d.path(rel)); err != nil {
+		return fmt.Errorf("creating symlink %s: %w", d.path(rel), err)
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// hostileArchive returns a tar.gz of the given headers, in order. A
+// regular file's contents are the letter x repeated hdr.Size times.
+func hostileArchive(t *testing.T, hdrs ...*tar.Header) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, hdr := range hdrs {
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader %s: %v", hdr.Name, err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write(bytes.Repeat([]byte("x"), int(hdr.Size)))
+		}
+	}
+	tw.Close()
+	gw.Close()
+	return buf.Bytes()
+}
+
+func reg(name string, size int64) *tar.Header {
+	return &tar.Header{Typeflag: tar.TypeReg, Name: name, Size: size}
+}
+
+func TestExtractArchiveHostile(t *testing.T) {
+	tests := []struct {
+		name    string
+		hdrs    []*tar.Header
+		wantErr string
+	}{
+		{
+			name: "write through archived symlink",
+			hdrs: []*tar.Header{
+				{Typeflag: tar.TypeSymlink, Name: "data/escape", Linkname: "OUTSIDE"},
+				reg("data/escape/passwd", 4),
+			},
+			wantErr: "through symlink",
+		},
+		{
+			name: "write through relative symlink",
+			hdrs: []*tar.Header{
+				{Typeflag: tar.TypeSymlink, Name: "data/up", Linkname: "../.."},
+				reg("data/up/passwd", 4),
+			},
+			wantErr: "through symlink",
+		},
+		{
+			name:    "dot-dot path",
+			hdrs:    []*tar.Header{reg("data/../../passwd", 4)},
+			wantErr: "invalid path",
+		},
+		{
+			name:    "absolute path",
+			hdrs:    []*tar.Header{reg("/passwd", 4)},
+			wantErr: "invalid path",
+		},
+		{
+			// The directory entry replaces the symlink, so the file lands
+			// inside the destination.
+			name: "symlink replaced by directory entry",
+			hdrs: []*tar.Header{
+				{Typeflag: tar.TypeSymlink, Name: "data/d", Linkname: "OUTSIDE"},
+				{Typeflag: tar.TypeDir, Name: "data/d/", Mode: 0755},
+				reg("data/d/passwd", 4),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := t.TempDir()
+			outside := filepath.Join(base, "outside")
+			os.MkdirAll(outside, 0755)
+			dest := filepath.Join(base, "dest", "inner")
+			for _, hdr := range tt.hdrs {
+				hdr.Linkname = strings.ReplaceAll(hdr.Linkname, "OUTSIDE", outside)
+			}
+
+			err := ExtractArchive(bytes.NewReader(hostileArchive(t, tt.hdrs...)), dest, ExtractOptions{})
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("ExtractArchive: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want one containing %q", err, tt.wantErr)
+			}
+			for _, p := range []string{filepath.Join(outside, "passwd"), filepath.Join(base, "passwd"), filepath.Join(base, "dest", "passwd")} {
+				if _, err := os.Lstat(p); err == nil {
+					t.Errorf("%s was written outside the destination", p)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractArchiveRefusesLiveSymlinkParent(t *testing.T) {
+	base := t.TempDir()
+	outside := filepath.Join(base, "outside")
+	dest := filepath.Join(base, "dest")
+	os.MkdirAll(outside, 0755)
+	os.MkdirAll(dest, 0755)
+	os.Symlink(outside, filepath.Join(dest, "data"))
+
+	archive := hostileArchive(t, reg("data/passwd", 4))
+	err := ExtractArchive(bytes.NewReader(archive), dest, ExtractOptions{})
+	if err == nil || !strings.Contains(err.Error(), "through symlink") {
+		t.Fatalf("err = %v, want a refusal", err)
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "passwd")); err == nil {
+		t.Error("file written through the live symlink")
+	}
+}
+
+func TestExtractArchiveReplacesSymlinkedFile(t *testing.T) {
+	base := t.TempDir()
+	outside := filepath.Join(base, "outside")
+	dest := filepath.Join(base, "dest")
+	os.MkdirAll(dest, 0755)
+	os.WriteFile(outside, []byte("untouched"), 0644)
+
+	// The symlink and then a file of the same name: the file replaces the
+	// link instead of being written through it.
+	archive := hostileArchive(t,
+		&tar.Header{Typeflag: tar.TypeSymlink, Name: "f", Linkname: outside},
+		reg("f", 4),
+	)
+	if err := ExtractArchive(bytes.NewReader(archive), dest, ExtractOptions{}); err != nil {
+		t.Fatalf("ExtractArchive: %v", err)
+	}
+	if got := readFile(t, outside); got != "untouched" {
+		t.Errorf("outside = %q, want it untouched", got)
+	}
+	if fi, err := os.Lstat(filepath.Join(dest, "f")); err != nil || !fi.Mode().IsRegular() {
+		t.Errorf("f = %v, %v; want a regular file", fi, err)
+	}
+}
+
+func TestExtractArchiveSkipsSpecialEntries(t *testing.T) {
+	dest := t.TempDir()
+	archive := hostileArchive(t,
+		&tar.Header{Typeflag: tar.TypeChar, Name: "null", Devmajor: 1, Devminor: 3},
+		&tar.Header{Typeflag: tar.TypeBlock, Name: "sda", Devmajor: 8},
+		&tar.Header{Typeflag: tar.TypeFifo, Name: "fifo"},
+		&tar.Header{Typeflag: tar.TypeLink, Name: "hard", Linkname: "/etc/shadow"},
+		reg("ok", 2),
+	)
+	logs := captureLog(t)
+	if err := ExtractArchive(bytes.NewReader(archive), dest, ExtractOptions{}); err != nil {
+		t.Fatalf("ExtractArchive: %v", err)
+	}
+	for _, name := range []string{"null", "sda", "fifo", "hard"} {
+		if _, err := os.Lstat(filepath.Join(dest, name)); err == nil {
+			t.Errorf("%s was restored", name)
+		}
+		if !strings.Contains(logs.String(), "skipping "+name) {
+			t.Errorf("no warning for %s in %q", name, logs.String())
+		}
+	}
+	if got := readFile(t, filepath.Join(dest, "ok")); got != "xx" {
+		t.Errorf("ok = %q", got)
+	}
+}
+
+func TestExtractArchiveSetID(t *testing.T) {
+	archive := func() []byte {
+		return hostileArchive(t,
+			&tar.Header{Typeflag: tar.TypeReg, Name: "suid", Size: 1, Mode: 04755},
+			&tar.Header{Typeflag: tar.TypeDir, Name: "sgid/", Mode: 02775},
+		)
+	}
+
+	tests := []struct {
+		preserve bool
+		suid     os.FileMode
+		sgid     os.FileMode
+	}{
+		{false, 0755, 0775},
+		{true, 0755 | os.ModeSetuid, 0775 | os.ModeSetgid},
+	}
+	for _, tt := range tests {
+		dest := t.TempDir()
+		logs := captureLog(t)
+		if err := ExtractArchive(bytes.NewReader(archive()), dest, ExtractOptions{PreserveSpecial: tt.preserve}); err != nil {
+			t.Fatalf("ExtractArchive: %v", err)
+		}
+		fi, _ := os.Stat(filepath.Join(dest, "suid"))
+		if got := fi.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid); got != tt.suid {
+			t.Errorf("preserve=%v: suid mode = %v, want %v", tt.preserve, got, tt.suid)
+		}
+		// Directories are created with the process umask applied.
+		fi, _ = os.Stat(filepath.Join(dest, "sgid"))
+		if got := fi.Mode() & (os.ModeSetuid | os.ModeSetgid); got != tt.sgid&^os.ModePerm {
+			t.Errorf("preserve=%v: sgid bits = %v, want %v", tt.preserve, got, tt.sgid&^os.ModePerm)
+		}
+		if dropped := strings.Contains(logs.String(), "dropped set-user-ID"); dropped == tt.preserve {
+			t.Errorf("preserve=%v: log = %q", tt.preserve, logs.String())
+		}
+	}
+}
+
+func TestExtractArchiveLimits(t *testing.T) {
+	archive := hostileArchive(t, reg("a", 100), reg("b", 100), reg("c", 100))
+
+	tests := []struct {
+		name    string
+		opts    ExtractOptions
+		wantErr string
+	}{
+		{"no limits", ExtractOptions{}, ""},
+		{"within limits", ExtractOptions{MaxSize: 300, MaxEntries: 3}, ""},
+		{"too large", ExtractOptions{MaxSize: 250}, "more than 250 bytes"},
+		{"too many", ExtractOptions{MaxEntries: 2}, "more than 2 entries"},
+		{"filtered within limits", ExtractOptions{Include: []string{"a"}, MaxSize: 100, MaxEntries: 1}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ExtractArchive(bytes.NewReader(archive), t.TempDir(), tt.opts)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("err = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("err = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckRel(t *testing.T) {
+	for _, rel := range []string{"a", "a/b", "a/../b", "./a", "a/.."} {
+		if err := checkRel(rel); err != nil {
+			t.Errorf("checkRel(%q) = %v", rel, err)
+		}
+	}
+	for _, rel := range []string{"", "/a", "..", "../a", "a/../../b"} {
+		if err := checkRel(rel); err == nil {
+			t.Errorf("checkRel(%q) = nil, want an error", rel)
+		}
+	}
+}
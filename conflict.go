@@ -0,0 +1,157 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"log"
+	"os"
+)
+
+// What ExtractArchive does with an entry whose path already exists. An
+// existing directory is never a conflict for a directory entry: the two
+// are merged.
+const (
+	ConflictOverwrite = "overwrite"  // replace it (the default)
+	ConflictSkip      = "skip"       // keep it
+	ConflictKeepNewer = "keep-newer" // keep it if its mtime is newer than the archived copy's
+	ConflictRename    = "rename"     // move it aside to <path>.pre-restore-<ts>
+	ConflictFail      = "fail"       // stop the restore
+)
+
+// validateConflictPolicy checks an --on-conflict value; empty means
+// ConflictOverwrite.
+func validateConflictPolicy(p string) error {
+	switch p {
+	case "", ConflictOverwrite, ConflictSkip, ConflictKeepNewer, ConflictRename, ConflictFail:
+		return nil
+	}
+	return fmt.Errorf("unknown --on-conflict %q (want %s, %s, %s, %s or %s)",
+		p, ConflictOverwrite, ConflictSkip, ConflictKeepNewer, ConflictRename, ConflictFail)
+}
+
+// conflictResolver applies an ExtractOptions conflict policy, or with
+// dryRun only logs what it would do.
+type conflictResolver struct {
+	policy        string
+	dryRun        bool
+	ts            string // timestamp for renamed files
+	skipped       int
+	movedSidecars map[string]bool // sidecars moved aside with their database
+}
+
+// prepare gets target ready for the entry hdr and reports whether the
+// entry should be written: nothing is in the way, or it has been dealt
+// with according to the policy.
+func (c *conflictResolver) prepare(target string, hdr *tar.Header) (bool, error) {
+	fi, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		if c.dryRun {
+			log.Printf("[dry-run] would create %s", target)
+		}
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if hdr.Typeflag == tar.TypeDir && fi.IsDir() {
+		return true, nil
+	}
+
+	policy := c.policy
+	if policy == ConflictKeepNewer {
+		policy = ConflictOverwrite
+		if fi.ModTime().After(hdr.ModTime) {
+			policy = ConflictSkip
+		}
+	}
+
+	switch policy {
+	case ConflictSkip:
+		c.skipped++
+		if c.dryRun {
+			log.Printf("[dry-run] would skip %s (exists)", target)
+		}
+		return false, nil
+	case ConflictRename:
+		aside := target + preRestoreSuffix + c.ts
+		if c.dryRun {
+			log.Printf("[dry-run] would move %s to %s and create it", target, aside)
+			return true, c.moveSidecars(target, aside)
+		}
+		if err := os.Rename(target, aside); err != nil {
+			return false, fmt.Errorf("moving %s aside: %w", target, err)
+		}
+		log.Printf("moved %s to %s", target, aside)
+		return true, c.moveSidecars(target, aside)
+	case ConflictFail:
+		if c.dryRun {
+			log.Printf("[dry-run] %s exists; the restore would fail here", target)
+			return false, nil
+		}
+		return false, fmt.Errorf("%s already exists (--on-conflict %s)", target, ConflictFail)
+	}
+
+	// Overwrite. A directory in the way of anything else is left for the
+	// user to sort out rather than deleted with everything in it.
+	if fi.IsDir() {
+		return false, fmt.Errorf("%s is a directory in the live tree but not in the archive", target)
+	}
+	if c.dryRun {
+		log.Printf("[dry-run] would overwrite %s", target)
+		return true, nil
+	}
+	// Removing first means a symlink is replaced, not written through.
+	if err := os.Remove(target); err != nil {
+		return false, fmt.Errorf("removing %s: %w", target, err)
+	}
+	return true, nil
+}
+
+// moveSidecars moves any -wal, -shm and -journal files next to db, which
+// has been moved aside, along with it: they may hold committed
+// transactions that were never checkpointed into the database.
+func (c *conflictResolver) moveSidecars(db, aside string) error {
+	for _, suffix := range sqliteSidecarSuffixes {
+		p := db + suffix
+		if _, err := os.Lstat(p); err != nil {
+			continue
+		}
+		if c.movedSidecars == nil {
+			c.movedSidecars = map[string]bool{}
+		}
+		c.movedSidecars[p] = true
+		if c.dryRun {
+			log.Printf("[dry-run] would move %s to %s", p, aside+suffix)
+			continue
+		}
+		if err := os.Rename(p, aside+suffix); err != nil {
+			return fmt.Errorf("moving %s aside: %w", p, err)
+		}
+		log.Printf("moved %s to %s", p, aside+suffix)
+	}
+	return nil
+}
+
+// removeStaleSidecars removes the -wal, -shm and -journal files next to a
+// restored SQLite database: they belong to the database that was
+// overwritten, and SQLite would replay them into the restored one.
+// Sidecars moved aside with their database are left alone. Sidecars
+// that are in the archive are extracted after the database, so they
+// survive.
+func (c *conflictResolver) removeStaleSidecars(db string) error {
+	for _, suffix := range sqliteSidecarSuffixes {
+		p := db + suffix
+		if _, err := os.Lstat(p); err != nil || c.movedSidecars[p] {
+			continue
+		}
+		if c.dryRun {
+			log.Printf("[dry-run] would remove stale %s", p)
+			continue
+		}
+		if err := os.Remove(p); err != nil {
+			return fmt.Errorf("removing stale %s: %w", p, err)
+		}
+		log.Printf("removed stale %s", p)
+	}
+	return nil
+}
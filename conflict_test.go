@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// conflictArchive returns a tar.gz of a tree named "data" holding a.txt,
+// link -> a.txt and a SQLite database, all with an mtime of archived.
+func conflictArchive(t *testing.T, archived time.Time) []byte {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "data")
+	os.MkdirAll(dir, 0755)
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("archived"), 0644)
+	os.WriteFile(filepath.Join(dir, "app.db"), []byte(sqliteHeader+"archived pages"), 0644)
+	os.Symlink("a.txt", filepath.Join(dir, "link"))
+	for _, name := range []string{"a.txt", "app.db"} {
+		os.Chtimes(filepath.Join(dir, name), archived, archived)
+	}
+	lchtimes(t, filepath.Join(dir, "link"), archived)
+	var buf bytes.Buffer
+	if _, err := CreateArchive(&buf, dir, nil, nil, ArchiveOptions{}); err != nil {
+		t.Fatalf("CreateArchive: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// conflictDest returns a destination where data/a.txt and data/link (both
+// with mtime modified) and a stale data/app.db-wal already exist.
+func conflictDest(t *testing.T, modified time.Time) string {
+	t.Helper()
+	dest := t.TempDir()
+	dir := filepath.Join(dest, "data")
+	os.MkdirAll(dir, 0755)
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("live"), 0644)
+	os.Chtimes(filepath.Join(dir, "a.txt"), modified, modified)
+	os.WriteFile(filepath.Join(dir, "elsewhere"), []byte("not restored"), 0644)
+	os.Symlink("elsewhere", filepath.Join(dir, "link"))
+	lchtimes(t, filepath.Join(dir, "link"), modified)
+	os.WriteFile(filepath.Join(dir, "app.db-wal"), []byte("stale wal"), 0644)
+	return dest
+}
+
+// lchtimes sets the mtime of the symlink path itself.
+func lchtimes(t *testing.T, path string, mtime time.Time) {
+	t.Helper()
+	tv := unix.NsecToTimeval(mtime.UnixNano())
+	if err := unix.Lutimes(path, []unix.Timeval{tv, tv}); err != nil {
+		t.Fatalf("setting mtime of %s: %v", path, err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "<" + err.Error() + ">"
+	}
+	return string(data)
+}
+
+func TestExtractArchiveConflictPolicies(t *testing.T) {
+	archived := time.Date(2026, 2, 11, 3, 0, 0, 0, time.UTC)
+	archive := conflictArchive(t, archived)
+
+	tests := []struct {
+		policy   string
+		modified time.Time // mtime of the live a.txt
+		want     string    // contents of a.txt afterwards
+	}{
+		{ConflictOverwrite, archived.Add(time.Hour), "archived"},
+		{ConflictSkip, archived.Add(-time.Hour), "live"},
+		{ConflictKeepNewer, archived.Add(time.Hour), "live"},
+		{ConflictKeepNewer, archived.Add(-time.Hour), "archived"},
+		{ConflictRename, archived, "archived"},
+	}
+	for _, tt := range tests {
+		dest := conflictDest(t, tt.modified)
+		if err := ExtractArchive(bytes.NewReader(archive), dest, ExtractOptions{OnConflict: tt.policy}); err != nil {
+			t.Errorf("%s: ExtractArchive: %v", tt.policy, err)
+			continue
+		}
+		if got := readFile(t, filepath.Join(dest, "data", "a.txt")); got != tt.want {
+			t.Errorf("%s (live mtime %v): a.txt = %q, want %q", tt.policy, tt.modified, got, tt.want)
+		}
+		// Whatever the policy, a symlink in the way is never written through.
+		if got := readFile(t, filepath.Join(dest, "data", "elsewhere")); got != "not restored" {
+			t.Errorf("%s: wrote through the existing symlink: elsewhere = %q", tt.policy, got)
+		}
+		if tt.policy == ConflictRename {
+			aside, _ := filepath.Glob(filepath.Join(dest, "data", "a.txt"+preRestoreSuffix+"*"))
+			if len(aside) != 1 || readFile(t, aside[0]) != "live" {
+				t.Errorf("rename: live a.txt not kept aside: %v", aside)
+			}
+		}
+	}
+}
+
+func TestExtractArchiveConflictFail(t *testing.T) {
+	archive := conflictArchive(t, time.Now())
+	dest := conflictDest(t, time.Now())
+	err := ExtractArchive(bytes.NewReader(archive), dest, ExtractOptions{OnConflict: ConflictFail})
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("err = %v, want an already exists error", err)
+	}
+	if got := readFile(t, filepath.Join(dest, "data", "a.txt")); got != "live" {
+		t.Errorf("a.txt = %q after a failed restore, want it untouched", got)
+	}
+
+	if err := ExtractArchive(bytes.NewReader(archive), dest, ExtractOptions{OnConflict: "clobber"}); err == nil {
+		t.Error("want error for unknown policy")
+	}
+}
+
+func TestExtractArchiveRemovesStaleSidecars(t *testing.T) {
+	archive := conflictArchive(t, time.Now())
+	dest := conflictDest(t, time.Now())
+	if err := ExtractArchive(bytes.NewReader(archive), dest, ExtractOptions{}); err != nil {
+		t.Fatalf("ExtractArchive: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "data", "app.db-wal")); !os.IsNotExist(err) {
+		t.Errorf("stale app.db-wal survived the restore: %v", err)
+	}
+	if got := readFile(t, filepath.Join(dest, "data", "app.db")); got != sqliteHeader+"archived pages" {
+		t.Errorf("app.db = %q", got)
+	}
+}
+
+func TestExtractArchiveDryRun(t *testing.T) {
+	archived := time.Date(2026, 2, 11, 3, 0, 0, 0, time.UTC)
+	archive := conflictArchive(t, archived)
+	dest := conflictDest(t, archived.Add(time.Hour))
+	logs := captureLog(t)
+
+	opts := ExtractOptions{OnConflict: ConflictKeepNewer, DryRun: true}
+	if err := ExtractArchive(bytes.NewReader(archive), dest, opts); err != nil {
+		t.Fatalf("ExtractArchive: %v", err)
+	}
+	data := filepath.Join(dest, "data")
+	for _, want := range []string{
+		"would skip " + filepath.Join(data, "a.txt"),
+		"would create " + filepath.Join(data, "app.db"),
+		"would remove stale " + filepath.Join(data, "app.db-wal"),
+		"would skip " + filepath.Join(data, "link"), // newer: its mtime is an hour after the archived one
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("log missing %q:\n%s", want, logs)
+		}
+	}
+
+	if _, err := os.Lstat(filepath.Join(data, "app.db")); !os.IsNotExist(err) {
+		t.Error("dry run created app.db")
+	}
+	if _, err := os.Lstat(filepath.Join(data, "app.db-wal")); err != nil {
+		t.Error("dry run removed app.db-wal")
+	}
+	if target, _ := os.Readlink(filepath.Join(data, "link")); target != "elsewhere" {
+		t.Errorf("dry run replaced link (now -> %q)", target)
+	}
+}
+
+func TestExtractArchiveRenameKeepsSidecars(t *testing.T) {
+	archive := conflictArchive(t, time.Now())
+	dest := t.TempDir()
+	dir := filepath.Join(dest, "data")
+	os.MkdirAll(dir, 0755)
+	os.WriteFile(filepath.Join(dir, "app.db"), []byte(sqliteHeader+"live pages"), 0644)
+	os.WriteFile(filepath.Join(dir, "app.db-wal"), []byte("live wal"), 0644)
+	os.WriteFile(filepath.Join(dir, "app.db-shm"), []byte("live shm"), 0644)
+	captureLog(t)
+
+	if err := ExtractArchive(bytes.NewReader(archive), dest, ExtractOptions{OnConflict: ConflictRename}); err != nil {
+		t.Fatalf("ExtractArchive: %v", err)
+	}
+	aside, _ := filepath.Glob(filepath.Join(dir, "app.db"+preRestoreSuffix+"*"))
+	sort.Strings(aside)
+	if len(aside) != 3 {
+		t.Fatalf("moved aside: %v, want app.db with its -shm and -wal", aside)
+	}
+	db := aside[0]
+	for suffix, want := range map[string]string{"": sqliteHeader + "live pages", "-wal": "live wal", "-shm": "live shm"} {
+		if got := readFile(t, db+suffix); got != want {
+			t.Errorf("%s = %q, want %q", filepath.Base(db+suffix), got, want)
+		}
+	}
+	if got := readFile(t, filepath.Join(dir, "app.db")); got != sqliteHeader+"archived pages" {
+		t.Errorf("app.db = %q", got)
+	}
+	for _, suffix := range sqliteSidecarSuffixes {
+		if _, err := os.Lstat(filepath.Join(dir, "app.db"+suffix)); !os.IsNotExist(err) {
+			t.Errorf("app.db%s next to the restored database: %v", suffix, err)
+		}
+	}
+}
+
+func TestExtractArchiveRenameDryRunSidecars(t *testing.T) {
+	archive := conflictArchive(t, time.Now())
+	dest := t.TempDir()
+	dir := filepath.Join(dest, "data")
+	os.MkdirAll(dir, 0755)
+	os.WriteFile(filepath.Join(dir, "app.db"), []byte(sqliteHeader+"live pages"), 0644)
+	os.WriteFile(filepath.Join(dir, "app.db-wal"), []byte("live wal"), 0644)
+	logs := captureLog(t)
+
+	opts := ExtractOptions{OnConflict: ConflictRename, DryRun: true}
+	if err := ExtractArchive(bytes.NewReader(archive), dest, opts); err != nil {
+		t.Fatalf("ExtractArchive: %v", err)
+	}
+	wal := filepath.Join(dir, "app.db-wal")
+	if !strings.Contains(logs.String(), "would move "+wal+" to ") {
+		t.Errorf("log missing the move of app.db-wal:\n%s", logs)
+	}
+	if strings.Contains(logs.String(), "would remove stale "+wal) {
+		t.Errorf("dry run would remove a sidecar it moves aside:\n%s", logs)
+	}
+}
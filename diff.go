@@ -0,0 +1,411 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxTextDiffSize is the largest file, on either side, that --text shows a
+// line diff for.
+const maxTextDiffSize = 64 << 10
+
+// maxDiffCells bounds the table diffLines builds: the product of the line
+// counts of the two texts once lines they share at the start and end are
+// set aside. It keeps the table to 8 MB; texts that differ more are only
+// reported as different.
+const maxDiffCells = 1 << 20
+
+// diffContext is the number of unchanged lines shown around each change in
+// a text diff.
+const diffContext = 3
+
+// archiveEntry is what a diff compares about one archive entry.
+type archiveEntry struct {
+	Name     string
+	Type     byte
+	Mode     int64
+	Uid, Gid int
+	Size     int64
+	ModTime  time.Time
+	Linkname string
+	Hash     string // SHA-256 of the contents of regular files
+	Text     []byte // contents of small text files, if asked for
+}
+
+// IndexArchive reads the tar.gz archive from r and returns its entries by
+// name. With keepText, the contents of regular files up to
+// maxTextDiffSize that look like text are kept too.
+func IndexArchive(r io.Reader, keepText bool) (map[string]*archiveEntry, error) {
+	entries := map[string]*archiveEntry{}
+	err := WalkArchive(r, func(hdr *tar.Header, r io.Reader) error {
+		e := &archiveEntry{
+			Name:     strings.TrimSuffix(hdr.Name, "/"),
+			Type:     hdr.Typeflag,
+			Mode:     hdr.Mode,
+			Uid:      hdr.Uid,
+			Gid:      hdr.Gid,
+			Size:     hdr.Size,
+			ModTime:  hdr.ModTime,
+			Linkname: hdr.Linkname,
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			h := sha256.New()
+			var text bytes.Buffer
+			w := io.Writer(h)
+			keep := keepText && hdr.Size <= maxTextDiffSize
+			if keep {
+				w = io.MultiWriter(h, &text)
+			}
+			if _, err := io.Copy(w, r); err != nil {
+				return fmt.Errorf("reading %s: %w", hdr.Name, err)
+			}
+			e.Hash = fmt.Sprintf("%x", h.Sum(nil))
+			if keep && isText(text.Bytes()) {
+				e.Text = append([]byte{}, text.Bytes()...)
+			}
+		}
+		entries[e.Name] = e
+		return nil
+	})
+	return entries, err
+}
+
+// isText reports whether data looks like text: valid UTF-8 with no NULs.
+func isText(data []byte) bool {
+	return utf8.Valid(data) && bytes.IndexByte(data, 0) < 0
+}
+
+// indexLive indexes what an archive of d would hold right now, built the
+// same way as a backup (excludes, SQLite snapshots and archive options
+// included) but never written anywhere.
+func indexLive(d Directory, keepText bool) (map[string]*archiveEntry, error) {
+	snap, err := PrepareSnapshots(d)
+	if err != nil {
+		return nil, fmt.Errorf("preparing snapshots: %w", err)
+	}
+	defer snap.Cleanup()
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := CreateArchive(pw, d.Path, snap.Overrides, snap.Excludes, d.ArchiveOptions())
+		pw.CloseWithError(err)
+	}()
+	entries, err := IndexArchive(pr, keepText)
+	pr.Close()
+	return entries, err
+}
+
+// Change kinds, as printed by diff.
+const (
+	changeAdded    = "added"
+	changeRemoved  = "removed"
+	changeModified = "modified" // contents, type or link target
+	changeMetadata = "metadata" // mode, owner or mtime only
+)
+
+// Change is one difference between two archives.
+type Change struct {
+	Kind   string
+	Name   string
+	Detail string // what changed, for modified and metadata changes
+	Old    *archiveEntry
+	New    *archiveEntry
+}
+
+// DiffEntries compares two indexed archives and returns their differences
+// ordered by name. Directory mtimes are ignored, since they change with
+// any change to the directory's contents.
+func DiffEntries(old, new map[string]*archiveEntry) []Change {
+	var changes []Change
+	for name, o := range old {
+		n, ok := new[name]
+		if !ok {
+			changes = append(changes, Change{Kind: changeRemoved, Name: name, Old: o})
+			continue
+		}
+		if c, changed := compareEntries(o, n); changed {
+			changes = append(changes, c)
+		}
+	}
+	for name, n := range new {
+		if _, ok := old[name]; !ok {
+			changes = append(changes, Change{Kind: changeAdded, Name: name, New: n})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	return changes
+}
+
+// compareEntries describes how the same entry differs between two
+// archives.
+func compareEntries(o, n *archiveEntry) (Change, bool) {
+	c := Change{Name: o.Name, Old: o, New: n}
+	var details []string
+	switch {
+	case o.Type != n.Type:
+		c.Kind = changeModified
+		details = append(details, "type changed")
+	case o.Hash != n.Hash:
+		c.Kind = changeModified
+		if o.Size != n.Size {
+			details = append(details, fmt.Sprintf("size %d -> %d", o.Size, n.Size))
+		} else {
+			details = append(details, "contents changed")
+		}
+	case o.Linkname != n.Linkname:
+		c.Kind = changeModified
+		details = append(details, fmt.Sprintf("target %s -> %s", o.Linkname, n.Linkname))
+	}
+
+	if o.Mode != n.Mode {
+		details = append(details, fmt.Sprintf("mode %04o -> %04o", o.Mode, n.Mode))
+	}
+	if o.Uid != n.Uid || o.Gid != n.Gid {
+		details = append(details, fmt.Sprintf("owner %d:%d -> %d:%d", o.Uid, o.Gid, n.Uid, n.Gid))
+	}
+	if o.Type != tar.TypeDir && !o.ModTime.Equal(n.ModTime) {
+		details = append(details, fmt.Sprintf("mtime %s -> %s", o.ModTime.UTC().Format(time.RFC3339), n.ModTime.UTC().Format(time.RFC3339)))
+	}
+	if len(details) == 0 {
+		return c, false
+	}
+	if c.Kind == "" {
+		c.Kind = changeMetadata
+	}
+	c.Detail = strings.Join(details, ", ")
+	return c, true
+}
+
+// WriteChanges prints changes to w, one per line. With text, modified text
+// files small enough to compare are followed by a unified diff.
+func WriteChanges(w io.Writer, changes []Change, oldLabel, newLabel string, text bool) {
+	for _, c := range changes {
+		line := fmt.Sprintf("%-8s %s", c.Kind, c.Name)
+		if c.Detail != "" {
+			line += " (" + c.Detail + ")"
+		}
+		fmt.Fprintln(w, line)
+		if text && c.Kind == changeModified && c.Old.Text != nil && c.New.Text != nil {
+			writeUnifiedDiff(w, oldLabel+"/"+c.Name, newLabel+"/"+c.Name, c.Old.Text, c.New.Text)
+		}
+	}
+}
+
+// writeUnifiedDiff writes a unified diff of two texts to w.
+func writeUnifiedDiff(w io.Writer, oldName, newName string, old, new []byte) {
+	a, b := splitLines(old), splitLines(new)
+	ops, ok := diffLines(a, b)
+	if !ok {
+		fmt.Fprintf(w, "Files %s and %s differ in too many lines to show\n", oldName, newName)
+		return
+	}
+
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", oldName, newName)
+	// Group the edits into hunks with diffContext lines of context.
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		start := max(i-diffContext, 0)
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(ops) && ops[run].kind == ' ' {
+				run++
+			}
+			if run == len(ops) || run-end > 2*diffContext {
+				end = min(end+diffContext, len(ops))
+				break
+			}
+			end = run
+		}
+
+		aStart, bStart := ops[start].a, ops[start].b
+		var aLen, bLen int
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				aLen++
+			}
+			if op.kind != '-' {
+				bLen++
+			}
+		}
+		fmt.Fprintf(w, "@@ -%s +%s @@\n", hunkRange(aStart, aLen), hunkRange(bStart, bLen))
+		for _, op := range ops[start:end] {
+			fmt.Fprintf(w, "%c%s\n", op.kind, op.line)
+		}
+		i = end
+	}
+}
+
+// hunkRange formats one side of a hunk header; start is 0-based.
+func hunkRange(start, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if n == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
+
+func splitLines(data []byte) []string {
+	s := strings.TrimSuffix(string(data), "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// lineOp is one line of an edit script: ' ' kept, '-' removed or '+'
+// added, with the 0-based position it has reached in each text.
+type lineOp struct {
+	kind byte
+	line string
+	a, b int
+}
+
+// diffLines returns an edit script turning a into b, from their longest
+// common subsequence, or false if the texts differ in too many lines to
+// compare (see maxDiffCells).
+func diffLines(a, b []string) ([]lineOp, bool) {
+	// Lines shared at the start and end are kept as they are, so the
+	// quadratic table only covers the part that changed.
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	ma, mb := a[pre:len(a)-suf], b[pre:len(b)-suf]
+	if len(ma)*len(mb) > maxDiffCells {
+		return nil, false
+	}
+
+	lcs := make([][]int, len(ma)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(mb)+1)
+	}
+	for i := len(ma) - 1; i >= 0; i-- {
+		for j := len(mb) - 1; j >= 0; j-- {
+			if ma[i] == mb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var ops []lineOp
+	for i := 0; i < pre; i++ {
+		ops = append(ops, lineOp{' ', a[i], i, i})
+	}
+	i, j := 0, 0
+	for i < len(ma) || j < len(mb) {
+		switch {
+		case i < len(ma) && j < len(mb) && ma[i] == mb[j]:
+			ops = append(ops, lineOp{' ', ma[i], pre + i, pre + j})
+			i++
+			j++
+		case i < len(ma) && (j == len(mb) || lcs[i+1][j] >= lcs[i][j+1]):
+			// Removals come before additions, as in diff -u.
+			ops = append(ops, lineOp{'-', ma[i], pre + i, pre + j})
+			i++
+		default:
+			ops = append(ops, lineOp{'+', mb[j], pre + i, pre + j})
+			j++
+		}
+	}
+	for k := 0; k < suf; k++ {
+		ia, ib := len(a)-suf+k, len(b)-suf+k
+		ops = append(ops, lineOp{' ', a[ia], ia, ib})
+	}
+	return ops, true
+}
+
+// runDiff handles the "diff" subcommand.
+func runDiff(cfg *Config, args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	live := fs.Bool("live", false, "compare the snapshot with the live directory instead of another snapshot")
+	fromHost := addFromHostFlag(fs, cfg)
+	text := fs.Bool("text", false, fmt.Sprintf("show a unified diff of modified text files up to %d KiB", maxTextDiffSize>>10))
+	positional := parseInterspersed(fs, args)
+
+	if len(positional) < 2 || len(positional) > 3 || (*live && len(positional) == 3) {
+		fmt.Fprintf(os.Stderr, "Usage: pi-backup diff <directory> <snapshot> [<snapshot>|--live] [--text] [--from-host <name>]\n")
+		os.Exit(1)
+	}
+	dir := positional[0]
+
+	ctx := context.Background()
+	keys, err := ListHostBackups(ctx, cfg, *fromHost, dir)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	resolve := func(spec string) string {
+		key, err := ResolveSnapshot(keys, spec, "")
+		if err != nil {
+			log.Fatalf("error: %s: %v", dir, err)
+		}
+		return key
+	}
+	index := func(key string) map[string]*archiveEntry {
+		log.Printf("reading s3://%s/%s", cfg.Bucket, key)
+		var entries map[string]*archiveEntry
+		err := StreamBackup(ctx, cfg, key, func(r io.Reader) error {
+			var err error
+			entries, err = IndexArchive(r, *text)
+			return err
+		})
+		if err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		return entries
+	}
+
+	oldKey := resolve(positional[1])
+	oldLabel := snapshotName(oldKey)
+	var newEntries map[string]*archiveEntry
+	var newLabel string
+	if *live {
+		d, ok := cfg.FindDirectory(dir)
+		if !ok {
+			log.Fatalf("error: --live needs %s to be a configured directory", dir)
+		}
+		newLabel = "live"
+		if newEntries, err = indexLive(d, *text); err != nil {
+			log.Fatalf("error: reading %s: %v", dir, err)
+		}
+	} else {
+		newSpec := "latest"
+		if len(positional) == 3 {
+			newSpec = positional[2]
+		}
+		newKey := resolve(newSpec)
+		newLabel = snapshotName(newKey)
+		newEntries = index(newKey)
+	}
+	oldEntries := index(oldKey)
+
+	changes := DiffEntries(oldEntries, newEntries)
+	log.Printf("%s -> %s: %d changes", oldLabel, newLabel, len(changes))
+	WriteChanges(os.Stdout, changes, oldLabel, newLabel, *text)
+}
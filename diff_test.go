@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// indexDir archives dir the way a backup would and indexes the result.
+func indexDir(t *testing.T, dir string) map[string]*archiveEntry {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := CreateArchive(&buf, dir, nil, nil, ArchiveOptions{}); err != nil {
+		t.Fatalf("CreateArchive: %v", err)
+	}
+	entries, err := IndexArchive(&buf, true)
+	if err != nil {
+		t.Fatalf("IndexArchive: %v", err)
+	}
+	return entries
+}
+
+func TestDiffEntries(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	mtime := time.Date(2026, 2, 11, 3, 0, 0, 0, time.UTC)
+	write := func(name, content string) {
+		p := filepath.Join(dir, name)
+		os.WriteFile(p, []byte(content), 0644)
+		os.Chtimes(p, mtime, mtime)
+	}
+	write("same.txt", "same")
+	write("edited.yaml", "a: 1\nb: 2\n")
+	write("chmod.txt", "x")
+	write("gone.txt", "bye")
+	os.Symlink("same.txt", filepath.Join(dir, "link"))
+	before := indexDir(t, dir)
+
+	write("edited.yaml", "a: 1\nb: 3\n")
+	os.Chmod(filepath.Join(dir, "chmod.txt"), 0600)
+	os.Remove(filepath.Join(dir, "gone.txt"))
+	write("sub/new.txt", "hi")
+	os.Remove(filepath.Join(dir, "link"))
+	os.Symlink("edited.yaml", filepath.Join(dir, "link"))
+	after := indexDir(t, dir)
+
+	var got []string
+	for _, c := range DiffEntries(before, after) {
+		got = append(got, c.Kind+" "+c.Name+" "+c.Detail)
+	}
+	want := []string{
+		"metadata data/chmod.txt mode 0644 -> 0600",
+		"modified data/edited.yaml contents changed",
+		"removed data/gone.txt ",
+		"modified data/link target same.txt -> edited.yaml",
+		"added data/sub/new.txt ",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("DiffEntries:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	if changes := DiffEntries(after, after); len(changes) != 0 {
+		t.Errorf("identical archives differ: %v", changes)
+	}
+}
+
+func TestWriteChangesText(t *testing.T) {
+	old := &archiveEntry{Name: "data/c.yaml", Hash: "1", Text: []byte("a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n")}
+	new := &archiveEntry{Name: "data/c.yaml", Hash: "2", Text: []byte("a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\n")}
+	c, _ := compareEntries(old, new)
+
+	var out bytes.Buffer
+	WriteChanges(&out, []Change{c}, "old", "new", true)
+	want := `modified data/c.yaml (contents changed)
+--- old/data/c.yaml
++++ new/data/c.yaml
+@@ -1,5 +1,5 @@
+ a
+-b
++B
+ c
+ d
+ e
+@@ -8,3 +8,4 @@
+ h
+ i
+ j
++k
+`
+	if out.String() != want {
+		t.Errorf("WriteChanges:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestWriteChangesTextTooLarge(t *testing.T) {
+	// Small in bytes but tens of thousands of lines, with no common first
+	// or last line to set aside.
+	blank := strings.Repeat("\n", 30000)
+	old := &archiveEntry{Name: "data/c.txt", Hash: "1", Text: []byte("x\n" + blank + "y\n")}
+	new := &archiveEntry{Name: "data/c.txt", Hash: "2", Text: []byte("y\n" + blank + "x\n")}
+	c, _ := compareEntries(old, new)
+
+	var out bytes.Buffer
+	WriteChanges(&out, []Change{c}, "old", "new", true)
+	want := "modified data/c.txt (contents changed)\nFiles old/data/c.txt and new/data/c.txt differ in too many lines to show\n"
+	if out.String() != want {
+		t.Errorf("WriteChanges:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestDiffLinesSetsAsideCommonLines(t *testing.T) {
+	// A one-line change in a long file still gets a diff.
+	a := strings.Split(strings.Repeat("same\n", 5000)+"old"+strings.Repeat("\nsame", 5000), "\n")
+	b := strings.Split(strings.Repeat("same\n", 5000)+"new"+strings.Repeat("\nsame", 5000), "\n")
+	ops, ok := diffLines(a, b)
+	if !ok {
+		t.Fatal("diffLines gave up on a one-line change")
+	}
+	var changed []string
+	for _, op := range ops {
+		if op.kind != ' ' {
+			changed = append(changed, fmt.Sprintf("%c%s@%d,%d", op.kind, op.line, op.a, op.b))
+		}
+	}
+	if got := strings.Join(changed, " "); got != "-old@5000,5000 +new@5001,5000" {
+		t.Errorf("changes = %s", got)
+	}
+	if len(ops) != 10002 {
+		t.Errorf("got %d ops, want 10002", len(ops))
+	}
+}
+
+func TestIndexArchiveSkipsBinaryText(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	os.MkdirAll(dir, 0755)
+	os.WriteFile(filepath.Join(dir, "bin"), []byte{0, 1, 2}, 0644)
+	os.WriteFile(filepath.Join(dir, "big.txt"), bytes.Repeat([]byte("x"), maxTextDiffSize+1), 0644)
+	os.WriteFile(filepath.Join(dir, "small.txt"), []byte("ok"), 0644)
+
+	entries := indexDir(t, dir)
+	for name, wantText := range map[string]bool{"data/bin": false, "data/big.txt": false, "data/small.txt": true} {
+		e := entries[name]
+		if e == nil || e.Hash == "" {
+			t.Fatalf("%s not indexed with a hash", name)
+		}
+		if (e.Text != nil) != wantText {
+			t.Errorf("%s: kept text = %v, want %v", name, e.Text != nil, wantText)
+		}
+	}
+}
+
+func TestIndexLive(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	os.MkdirAll(filepath.Join(dir, "cache"), 0755)
+	os.WriteFile(filepath.Join(dir, "keep.txt"), []byte("k"), 0644)
+	os.WriteFile(filepath.Join(dir, "cache", "tmp"), []byte("t"), 0644)
+
+	entries, err := indexLive(Directory{Path: dir, Excludes: []string{"cache"}}, false)
+	if err != nil {
+		t.Fatalf("indexLive: %v", err)
+	}
+	if entries["data/keep.txt"] == nil {
+		t.Error("keep.txt missing from the live index")
+	}
+	if entries["data/cache"] != nil || entries["data/cache/tmp"] != nil {
+		t.Error("excluded cache directory is in the live index")
+	}
+}
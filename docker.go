@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDockerSocket = "/var/run/docker.sock"
+	// defaultMaxDowntime bounds how long containers stay paused or stopped
+	// when a directory doesn't set docker.max_downtime.
+	defaultMaxDowntime = 10 * time.Minute
+)
+
+// docker actions.
+const (
+	DockerPause = "pause"
+	DockerStop  = "stop"
+)
+
+// DockerOptions quiesces containers while a directory is being archived.
+type DockerOptions struct {
+	Containers  []string      `yaml:"containers"`
+	Action      string        `yaml:"action,omitempty"` // "pause" (default) or "stop"
+	MaxDowntime time.Duration `yaml:"max_downtime,omitempty"`
+	Socket      string        `yaml:"socket,omitempty"`
+}
+
+// validate checks o. field names the docker block in errors.
+func (o DockerOptions) validate(field string) error {
+	if len(o.Containers) == 0 {
+		return fmt.Errorf("config: %s.containers: at least one container is required", field)
+	}
+	for i, c := range o.Containers {
+		if c == "" {
+			return fmt.Errorf("config: %s.containers[%d] is empty", field, i)
+		}
+	}
+	switch o.Action {
+	case "", DockerPause, DockerStop:
+	default:
+		return fmt.Errorf("config: %s.action: must be %q or %q, got %q", field, DockerPause, DockerStop, o.Action)
+	}
+	if o.MaxDowntime < 0 {
+		return fmt.Errorf("config: %s.max_downtime must not be negative", field)
+	}
+	return nil
+}
+
+// action returns the configured action, defaulting to pause.
+func (o DockerOptions) action() string {
+	if o.Action == "" {
+		return DockerPause
+	}
+	return o.Action
+}
+
+// DockerClient talks to the Docker Engine API over its unix socket.
+type DockerClient struct {
+	http *http.Client
+}
+
+// NewDockerClient returns a client for the engine listening on socket
+// whose requests give up after timeout, so a hung engine can't hold a
+// backup up indefinitely.
+func NewDockerClient(socket string, timeout time.Duration) *DockerClient {
+	return &DockerClient{http: &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}}
+}
+
+// containerState is the part of GET /containers/{id}/json we need.
+type containerState struct {
+	State struct {
+		Running bool
+		Paused  bool
+	}
+}
+
+func (c *DockerClient) do(ctx context.Context, method, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, method, "http://docker"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotModified {
+		var apiErr struct{ Message string }
+		body, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Message != "" {
+			return fmt.Errorf("%s %s: %s", method, path, apiErr.Message)
+		}
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if v != nil {
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+	return nil
+}
+
+// Inspect returns whether the container is running and whether it is paused.
+func (c *DockerClient) Inspect(ctx context.Context, name string) (running, paused bool, err error) {
+	var st containerState
+	if err := c.do(ctx, http.MethodGet, "/containers/"+url.PathEscape(name)+"/json", &st); err != nil {
+		return false, false, err
+	}
+	return st.State.Running, st.State.Paused, nil
+}
+
+// Action runs a container action such as "pause", "unpause", "stop" or
+// "start".
+func (c *DockerClient) Action(ctx context.Context, name, action string) error {
+	return c.do(ctx, http.MethodPost, "/containers/"+url.PathEscape(name)+"/"+action, nil)
+}
+
+// QuiesceContainers pauses or stops the running containers in o and
+// returns a function that resumes them. Containers that weren't running
+// (or, for pause, were already paused) are left alone and not resumed.
+//
+// If the returned resume function hasn't been called within o.MaxDowntime,
+// the containers are resumed anyway and a warning is logged; calling
+// resume afterwards is a no-op. If quiescing fails part way, the containers
+// already quiesced are resumed before the error is returned. Each request
+// to the engine also gives up after o.MaxDowntime, so an engine that stops
+// responding can't keep containers down for longer than that per request.
+func QuiesceContainers(ctx context.Context, o DockerOptions) (resume func() error, err error) {
+	socket := o.Socket
+	if socket == "" {
+		socket = defaultDockerSocket
+	}
+	action, undo := o.action(), "unpause"
+	if action == DockerStop {
+		undo = "start"
+	}
+	maxDowntime := o.MaxDowntime
+	if maxDowntime == 0 {
+		maxDowntime = defaultMaxDowntime
+	}
+
+	client := NewDockerClient(socket, maxDowntime)
+	var quiesced []string
+	var once sync.Once
+	var resumeErr error
+	resumeAll := func() error {
+		once.Do(func() {
+			// Resume in reverse order so dependencies come back first.
+			var errs []error
+			for i := len(quiesced) - 1; i >= 0; i-- {
+				name := quiesced[i]
+				// Use a fresh context: resuming must not be skipped just
+				// because the backup's context was cancelled.
+				if err := client.Action(context.Background(), name, undo); err != nil {
+					errs = append(errs, fmt.Errorf("%s %s: %w", undo, name, err))
+					continue
+				}
+				log.Printf("docker: %s %s", undo, name)
+			}
+			resumeErr = errors.Join(errs...)
+		})
+		return resumeErr
+	}
+
+	for _, name := range o.Containers {
+		running, paused, err := client.Inspect(ctx, name)
+		if err != nil {
+			if rerr := resumeAll(); rerr != nil {
+				log.Printf("error: resuming containers: %v", rerr)
+			}
+			return nil, fmt.Errorf("inspecting container %s: %w", name, err)
+		}
+		if !running || (action == DockerPause && paused) {
+			log.Printf("docker: %s is not running or already paused, leaving it alone", name)
+			continue
+		}
+		if err := client.Action(ctx, name, action); err != nil {
+			if rerr := resumeAll(); rerr != nil {
+				log.Printf("error: resuming containers: %v", rerr)
+			}
+			return nil, fmt.Errorf("%s container %s: %w", action, name, err)
+		}
+		log.Printf("docker: %s %s", action, name)
+		quiesced = append(quiesced, name)
+	}
+
+	state := "paused"
+	if action == DockerStop {
+		state = "stopped"
+	}
+	timer := time.AfterFunc(maxDowntime, func() {
+		log.Printf("warning: docker: containers still %s after max_downtime %s; resuming them while the backup continues", state, maxDowntime)
+		if err := resumeAll(); err != nil {
+			log.Printf("error: resuming containers: %v", err)
+		}
+	})
+	return func() error {
+		timer.Stop()
+		return resumeAll()
+	}, nil
+}
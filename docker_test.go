@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDocker is a minimal Docker Engine on a unix socket that tracks
+// container state and records the actions it receives.
+type fakeDocker struct {
+	mu      sync.Mutex
+	state   map[string]string // "running", "paused" or "exited"
+	calls   []string
+	failing string // action/name that returns an error, e.g. "pause/db"
+	hanging string // action/name that never answers, e.g. "pause/db"
+}
+
+func startFakeDocker(t *testing.T, state map[string]string) (*fakeDocker, string) {
+	t.Helper()
+	fd := &fakeDocker{state: state}
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(fd.serve))
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return fd, socket
+}
+
+func (fd *fakeDocker) serve(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/containers/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	name, action := parts[0], parts[1]
+	if fd.hanging == action+"/"+name {
+		// Until the client gives up, without holding up other requests.
+		<-r.Context().Done()
+		return
+	}
+
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	st, ok := fd.state[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message":"No such container: ` + name + `"}`))
+		return
+	}
+	if action == "json" {
+		w.Write([]byte(`{"State":{"Running":` + boolJSON(st != "exited") + `,"Paused":` + boolJSON(st == "paused") + `}}`))
+		return
+	}
+	fd.calls = append(fd.calls, action+"/"+name)
+	if fd.failing == action+"/"+name {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message":"boom"}`))
+		return
+	}
+	switch action {
+	case "pause":
+		fd.state[name] = "paused"
+	case "stop":
+		fd.state[name] = "exited"
+	case "unpause", "start":
+		fd.state[name] = "running"
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (fd *fakeDocker) snapshot() (map[string]string, []string) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	state := map[string]string{}
+	for k, v := range fd.state {
+		state[k] = v
+	}
+	return state, append([]string(nil), fd.calls...)
+}
+
+func boolJSON(b bool) string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
+
+func TestQuiesceContainersPause(t *testing.T) {
+	fd, socket := startFakeDocker(t, map[string]string{"app": "running", "db": "running", "idle": "exited"})
+
+	resume, err := QuiesceContainers(context.Background(), DockerOptions{
+		Containers: []string{"db", "app", "idle"},
+		Socket:     socket,
+	})
+	if err != nil {
+		t.Fatalf("QuiesceContainers: %v", err)
+	}
+	state, _ := fd.snapshot()
+	if state["app"] != "paused" || state["db"] != "paused" || state["idle"] != "exited" {
+		t.Fatalf("state while quiesced = %v", state)
+	}
+
+	if err := resume(); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if err := resume(); err != nil {
+		t.Fatalf("second resume: %v", err)
+	}
+	state, calls := fd.snapshot()
+	if state["app"] != "running" || state["db"] != "running" || state["idle"] != "exited" {
+		t.Errorf("state after resume = %v", state)
+	}
+	want := []string{"pause/db", "pause/app", "unpause/app", "unpause/db"}
+	if !equalSlice(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestQuiesceContainersStop(t *testing.T) {
+	fd, socket := startFakeDocker(t, map[string]string{"app": "running"})
+
+	resume, err := QuiesceContainers(context.Background(), DockerOptions{
+		Containers: []string{"app"},
+		Action:     DockerStop,
+		Socket:     socket,
+	})
+	if err != nil {
+		t.Fatalf("QuiesceContainers: %v", err)
+	}
+	if err := resume(); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	_, calls := fd.snapshot()
+	if want := []string{"stop/app", "start/app"}; !equalSlice(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestQuiesceContainersFailureResumesOthers(t *testing.T) {
+	fd, socket := startFakeDocker(t, map[string]string{"app": "running", "db": "running"})
+	fd.failing = "pause/db"
+
+	_, err := QuiesceContainers(context.Background(), DockerOptions{
+		Containers: []string{"app", "db"},
+		Socket:     socket,
+	})
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("err = %v, want pause failure", err)
+	}
+	state, _ := fd.snapshot()
+	if state["app"] != "running" {
+		t.Errorf("app = %s after failed quiesce, want running", state["app"])
+	}
+}
+
+func TestQuiesceContainersHungEngine(t *testing.T) {
+	fd, socket := startFakeDocker(t, map[string]string{"app": "running", "db": "running"})
+	fd.hanging = "pause/db"
+
+	start := time.Now()
+	_, err := QuiesceContainers(context.Background(), DockerOptions{
+		Containers:  []string{"app", "db"},
+		MaxDowntime: 100 * time.Millisecond,
+		Socket:      socket,
+	})
+	if err == nil || !strings.Contains(err.Error(), "pause container db") {
+		t.Fatalf("err = %v, want the pause to time out", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("QuiesceContainers took %s with a hung engine", elapsed)
+	}
+	state, _ := fd.snapshot()
+	if state["app"] != "running" {
+		t.Errorf("app = %s after the engine hung, want running", state["app"])
+	}
+}
+
+func TestQuiesceContainersUnknownContainer(t *testing.T) {
+	_, socket := startFakeDocker(t, map[string]string{})
+
+	_, err := QuiesceContainers(context.Background(), DockerOptions{
+		Containers: []string{"ghost"},
+		Socket:     socket,
+	})
+	if err == nil || !strings.Contains(err.Error(), "No such container") {
+		t.Fatalf("err = %v, want missing container error", err)
+	}
+}
+
+func TestQuiesceContainersMaxDowntime(t *testing.T) {
+	fd, socket := startFakeDocker(t, map[string]string{"app": "running"})
+
+	resume, err := QuiesceContainers(context.Background(), DockerOptions{
+		Containers:  []string{"app"},
+		MaxDowntime: 50 * time.Millisecond,
+		Socket:      socket,
+	})
+	if err != nil {
+		t.Fatalf("QuiesceContainers: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		state, _ := fd.snapshot()
+		if state["app"] == "running" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("app not resumed after max_downtime")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := resume(); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	_, calls := fd.snapshot()
+	if want := []string{"pause/app", "unpause/app"}; !equalSlice(calls, want) {
+		t.Errorf("calls = %v, want %v (resume after the guard should be a no-op)", calls, want)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Formats restore download can write a snapshot in.
+const (
+	FormatRaw = "raw" // the tar.gz exactly as stored in the bucket
+	FormatTar = "tar" // the archive decompressed
+	FormatZip = "zip" // the entries repacked into a zip file
+)
+
+// formatExtensions are the file extensions of downloads in each format.
+var formatExtensions = map[string]string{
+	FormatRaw: ".tar.gz",
+	FormatTar: ".tar",
+	FormatZip: ".zip",
+}
+
+// ConvertArchive writes the tar.gz archive read from r to w in format.
+func ConvertArchive(r io.Reader, w io.Writer, format string) error {
+	switch format {
+	case FormatRaw:
+		_, err := io.Copy(w, r)
+		return err
+	case FormatTar:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("opening gzip: %w", err)
+		}
+		defer gr.Close()
+		_, err = io.Copy(w, gr)
+		return err
+	case FormatZip:
+		return writeZip(r, w)
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// writeZip repacks the directories, files and symlinks of the tar.gz
+// archive read from r as a zip file written to w. Sparse files are written
+// out in full; other entry types have no zip equivalent and are skipped.
+func writeZip(r io.Reader, w io.Writer) error {
+	zw := zip.NewWriter(w)
+	err := WalkArchive(r, func(hdr *tar.Header, r io.Reader) error {
+		switch hdr.Typeflag {
+		case tar.TypeDir, tar.TypeReg, tar.TypeSymlink:
+		default:
+			log.Printf("warning: skipping %s: %s entries can't be stored in a zip file", hdr.Name, entryTypeName(hdr.Typeflag))
+			return nil
+		}
+
+		zh, err := zip.FileInfoHeader(hdr.FileInfo())
+		if err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+		zh.Name = hdr.Name
+		if hdr.Typeflag == tar.TypeDir && !strings.HasSuffix(zh.Name, "/") {
+			zh.Name += "/"
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			zh.Method = zip.Deflate
+		}
+		fw, err := zw.CreateHeader(zh)
+		if err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			_, err = io.Copy(fw, r)
+		case tar.TypeSymlink:
+			// Zip stores a symlink as a file holding its target.
+			_, err = io.WriteString(fw, hdr.Linkname)
+		}
+		if err != nil {
+			return fmt.Errorf("writing %s: %w", hdr.Name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// convertVerified converts the archive read from r into w like
+// ConvertArchive, then reads the rest of r and checks that the whole
+// stream hashes to want. An empty want skips the check.
+func convertVerified(r io.Reader, w io.Writer, format, want string) error {
+	h := sha256.New()
+	tr := io.TeeReader(r, h)
+	if err := ConvertArchive(tr, w, format); err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, tr); err != nil {
+		return fmt.Errorf("reading archive: %w", err)
+	}
+	if got := fmt.Sprintf("%x", h.Sum(nil)); want != "" && got != want {
+		return fmt.Errorf("%w: recorded sha256 %s, downloaded %s", errChecksumMismatch, want, got)
+	}
+	return nil
+}
+
+// writeOutput calls write with a temporary file next to output and renames
+// it into place once write succeeds, so output is never left half written
+// or unverified. The file is only readable by its owner, like the
+// directories backups usually come from. An output of "-" is stdout,
+// which can't be taken back: a failure there is only reported.
+func writeOutput(output string, write func(w io.Writer) error) error {
+	if output == "-" {
+		return write(os.Stdout)
+	}
+	f, err := os.CreateTemp(filepath.Dir(output), "."+filepath.Base(output)+".*.partial")
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), output)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// DownloadSnapshot streams the archive at key to output in format and
+// checks its checksum.
+func DownloadSnapshot(ctx context.Context, cfg *Config, key, output, format string) error {
+	info, err := StatObject(ctx, cfg.Region, cfg.Bucket, key)
+	if err != nil {
+		return err
+	}
+	if info.Hash == "" {
+		log.Printf("warning: no checksum recorded for s3://%s/%s; the download can't be verified", cfg.Bucket, key)
+	}
+
+	return writeOutput(output, func(w io.Writer) error {
+		return StreamBackup(ctx, cfg, key, func(r io.Reader) error {
+			return convertVerified(r, w, format, info.Hash)
+		})
+	})
+}
+
+// runDownload handles "restore download", which saves a snapshot as a
+// file instead of extracting it.
+func runDownload(cfg *Config, args []string) {
+	fs := flag.NewFlagSet("restore download", flag.ExitOnError)
+	snapshot := fs.String("snapshot", "", "download this snapshot instead of the latest (see restore --snapshot)")
+	at := fs.String("at", "", "download the newest snapshot taken at or before this local time")
+	fromHost := addFromHostFlag(fs, cfg)
+	output := fs.String("output", "", "write to this file, or - for stdout (default: <name>-<snapshot> with the format's extension)")
+	format := fs.String("format", FormatRaw, "raw (the stored tar.gz), tar (decompressed) or zip")
+	positional := parseInterspersed(fs, args)
+	if len(positional) != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: pi-backup restore download <directory> [--snapshot <TS>|--at <time>] [--from-host <name>] [--format raw|tar|zip] [--output <file>|-]\n")
+		os.Exit(1)
+	}
+	dir := positional[0]
+	ext, ok := formatExtensions[*format]
+	if !ok {
+		log.Fatalf("error: unknown --format %q (want %s, %s or %s)", *format, FormatRaw, FormatTar, FormatZip)
+	}
+	if *snapshot != "" && *at != "" {
+		log.Fatal("error: --snapshot and --at can't be combined")
+	}
+
+	ctx := context.Background()
+	key, err := FindSnapshot(ctx, cfg, *fromHost, dir, *snapshot, *at)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	if *output == "" {
+		*output = restoredName(dir) + "-" + snapshotName(key) + ext
+	}
+	// Progress goes to stderr, so stdout can carry the archive.
+	log.Printf("downloading s3://%s/%s", cfg.Bucket, key)
+
+	if err := DownloadSnapshot(ctx, cfg, key, *output, *format); err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	if *output != "-" {
+		log.Printf("wrote %s", *output)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestConvertArchiveRaw(t *testing.T) {
+	archive := browseArchive(t)
+	var out bytes.Buffer
+	if err := ConvertArchive(bytes.NewReader(archive), &out, FormatRaw); err != nil {
+		t.Fatalf("ConvertArchive: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), archive) {
+		t.Error("raw download differs from the archive")
+	}
+}
+
+func TestConvertArchiveTar(t *testing.T) {
+	var out bytes.Buffer
+	if err := ConvertArchive(bytes.NewReader(browseArchive(t)), &out, FormatTar); err != nil {
+		t.Fatalf("ConvertArchive: %v", err)
+	}
+	var names []string
+	tr := tar.NewReader(&out)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading tar: %v", err)
+		}
+		names = append(names, hdr.Name)
+	}
+	want := "data data/config data/config/configuration.yaml data/link data/notes.txt"
+	sort.Strings(names)
+	if got := strings.Join(names, " "); got != want {
+		t.Errorf("entries = %s, want %s", got, want)
+	}
+}
+
+func TestConvertArchiveZip(t *testing.T) {
+	archive := hostileArchive(t,
+		&tar.Header{Typeflag: tar.TypeDir, Name: "data/", Mode: 0755},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "data/a.txt", Size: 3, Mode: 0640},
+		&tar.Header{Typeflag: tar.TypeSymlink, Name: "data/link", Linkname: "a.txt"},
+		&tar.Header{Typeflag: tar.TypeFifo, Name: "data/fifo"},
+	)
+	logs := captureLog(t)
+	var out bytes.Buffer
+	if err := ConvertArchive(bytes.NewReader(archive), &out, FormatZip); err != nil {
+		t.Fatalf("ConvertArchive: %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatalf("reading zip: %v", err)
+	}
+	got := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("opening %s: %v", f.Name, err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		got[f.Name] = fmt.Sprintf("%v %s", f.Mode(), data)
+	}
+	want := map[string]string{
+		"data/":      fmt.Sprintf("%v ", os.ModeDir|0755),
+		"data/a.txt": fmt.Sprintf("%v xxx", os.FileMode(0640)),
+		"data/link":  fmt.Sprintf("%v a.txt", os.ModeSymlink|0644),
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("zip entries = %v, want %v", got, want)
+	}
+	if !strings.Contains(logs.String(), "skipping data/fifo") {
+		t.Errorf("no warning for the FIFO in %q", logs.String())
+	}
+}
+
+func TestConvertVerified(t *testing.T) {
+	archive := browseArchive(t)
+	sum := fmt.Sprintf("%x", sha256.Sum256(archive))
+
+	for _, format := range []string{FormatRaw, FormatTar, FormatZip} {
+		if err := convertVerified(bytes.NewReader(archive), io.Discard, format, sum); err != nil {
+			t.Errorf("%s: %v", format, err)
+		}
+		err := convertVerified(bytes.NewReader(archive), io.Discard, format, strings.Repeat("0", 64))
+		if !errors.Is(err, errChecksumMismatch) {
+			t.Errorf("%s: err = %v, want a checksum mismatch", format, err)
+		}
+	}
+	if err := convertVerified(bytes.NewReader(archive), io.Discard, FormatRaw, ""); err != nil {
+		t.Errorf("unrecorded checksum: %v", err)
+	}
+}
+
+func TestWriteOutput(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "backup.tar.gz")
+
+	err := writeOutput(output, func(w io.Writer) error {
+		io.WriteString(w, "half")
+		return errChecksumMismatch
+	})
+	if !errors.Is(err, errChecksumMismatch) {
+		t.Fatalf("err = %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("failed download left %v behind", entries)
+	}
+
+	if err := writeOutput(output, func(w io.Writer) error {
+		_, err := io.WriteString(w, "whole")
+		return err
+	}); err != nil {
+		t.Fatalf("writeOutput: %v", err)
+	}
+	if got := readFile(t, output); got != "whole" {
+		t.Errorf("output = %q", got)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("dir holds %v, want just the output", entries)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// changeRetryDelay is how long to wait before re-reading a file that
+// changed while it was being copied, giving the writer a moment to finish.
+const changeRetryDelay = 500 * time.Millisecond
+
+// entryReadError is a read failure part way through a file's contents.
+// By the time it happens the entry's header is already in the archive, so
+// the rest of the entry has been zero-filled to keep the archive readable.
+type entryReadError struct {
+	Written int64
+	Err     error
+}
+
+func (e *entryReadError) Error() string {
+	return fmt.Sprintf("read failed after %d bytes, rest of entry zero-filled: %v", e.Written, e.Err)
+}
+
+func (e *entryReadError) Unwrap() error { return e.Err }
+
+// copyEntry copies the size bytes declared in the entry's header from r
+// into tw and returns how many bytes came from r. If r ends early (the file
+// shrank) the remainder is zero-filled; if r has more (the file grew) the
+// extra bytes are left unread. Write errors are returned as-is; read errors
+// are returned as *entryReadError after zero-filling the entry.
+func copyEntry(tw *tar.Writer, r io.Reader, size int64) (int64, error) {
+	var readErr error
+	n, err := io.CopyN(tw, readerFunc(func(p []byte) (int, error) {
+		n, err := r.Read(p)
+		if err != nil && err != io.EOF {
+			readErr = err
+		}
+		return n, err
+	}), size)
+	if err == nil {
+		return n, nil
+	}
+	if readErr == nil && err != io.EOF {
+		return n, err // write error
+	}
+	if _, err := io.CopyN(tw, zeroReader{}, size-n); err != nil {
+		return n, err
+	}
+	if readErr != nil {
+		return n, &entryReadError{Written: n, Err: readErr}
+	}
+	return n, nil
+}
+
+// changedWhileReading compares f's current state with pre, the stat taken
+// before n bytes were read from it, and describes any change. It returns
+// "" if the read was consistent.
+func changedWhileReading(f *os.File, pre os.FileInfo, n int64) string {
+	post, err := f.Stat()
+	if err != nil {
+		return fmt.Sprintf("stat after read failed: %v", err)
+	}
+	switch {
+	case n != pre.Size() || post.Size() != pre.Size():
+		return fmt.Sprintf("size went from %d to %d bytes while being read (%d read)", pre.Size(), post.Size(), n)
+	case !post.ModTime().Equal(pre.ModTime()):
+		return "modified while being read"
+	}
+	return ""
+}
+
+// readStable reads f through once without keeping the bytes and
+// describes any change seen while reading, as changedWhileReading does,
+// or returns "" if the file is stable. It leaves f at the start.
+func readStable(f *os.File) (string, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	pre, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	n, err := io.Copy(io.Discard, f)
+	if err != nil {
+		return "", err
+	}
+	detail := changedWhileReading(f, pre, n)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return detail, nil
+}
+
+// spoolStable copies f into spool, re-reading up to retries more times
+// while the file keeps changing underneath the copy. On return spool holds
+// the bytes of the last read. attempts counts the reads made; detail
+// describes the change seen on the last read, or is "" if it was
+// consistent.
+func spoolStable(f, spool *os.File, retries int) (attempts int, detail string, err error) {
+	for attempts = 1; ; attempts++ {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return attempts, "", err
+		}
+		if err := spool.Truncate(0); err != nil {
+			return attempts, "", err
+		}
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return attempts, "", err
+		}
+		pre, err := f.Stat()
+		if err != nil {
+			return attempts, "", err
+		}
+		n, err := io.Copy(spool, f)
+		if err != nil {
+			return attempts, "", err
+		}
+		detail = changedWhileReading(f, pre, n)
+		if detail == "" || attempts > retries {
+			return attempts, detail, nil
+		}
+		time.Sleep(changeRetryDelay)
+	}
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+// zeroReader is an endless source of zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
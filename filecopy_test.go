@@ -0,0 +1,176 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestCopyEntryReadErrorZeroFills(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "f", Mode: 0644, Size: 10, Typeflag: tar.TypeReg})
+
+	eio := errors.New("input/output error")
+	n, err := copyEntry(tw, &failingReader{data: []byte("abcd"), err: eio}, 10)
+	var rerr *entryReadError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("copyEntry error = %v, want *entryReadError", err)
+	}
+	if n != 4 || rerr.Written != 4 || !errors.Is(err, eio) {
+		t.Errorf("got Written=%d err=%v, want 4 bytes and the read error", rerr.Written, err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("archive not well-formed after read error: %v", err)
+	}
+
+	tr := tar.NewReader(&buf)
+	if _, err := tr.Next(); err != nil {
+		t.Fatalf("tar: %v", err)
+	}
+	data, _ := io.ReadAll(tr)
+	if want := "abcd\x00\x00\x00\x00\x00\x00"; string(data) != want {
+		t.Errorf("entry = %q, want %q", data, want)
+	}
+}
+
+// readEntry returns the contents of the only entry in a tar stream.
+func readEntry(t *testing.T, buf *bytes.Buffer) string {
+	t.Helper()
+	tr := tar.NewReader(buf)
+	if _, err := tr.Next(); err != nil {
+		t.Fatalf("tar: %v", err)
+	}
+	data, err := io.ReadAll(tr)
+	if err != nil {
+		t.Fatalf("reading entry: %v", err)
+	}
+	return string(data)
+}
+
+func TestCopyEntryShrunkFileZeroFills(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "f", Mode: 0644, Size: 6, Typeflag: tar.TypeReg})
+
+	n, err := copyEntry(tw, strings.NewReader("abc"), 6)
+	if err != nil {
+		t.Fatalf("copyEntry: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("n = %d, want 3", n)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if got := readEntry(t, &buf); got != "abc\x00\x00\x00" {
+		t.Errorf("entry = %q", got)
+	}
+}
+
+func TestCopyEntryGrownFileTruncates(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "f", Mode: 0644, Size: 3, Typeflag: tar.TypeReg})
+
+	n, err := copyEntry(tw, strings.NewReader("abcdef"), 3)
+	if err != nil {
+		t.Fatalf("copyEntry: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("n = %d, want 3", n)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if got := readEntry(t, &buf); got != "abc" {
+		t.Errorf("entry = %q, want %q", got, "abc")
+	}
+}
+
+func TestChangedWhileReading(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grow.log")
+	os.WriteFile(path, []byte("line 1\n"), 0644)
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	pre, _ := f.Stat()
+
+	if d := changedWhileReading(f, pre, pre.Size()); d != "" {
+		t.Errorf("unchanged file reported as changed: %s", d)
+	}
+
+	af, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	af.WriteString("line 2\n")
+	af.Close()
+
+	if d := changedWhileReading(f, pre, pre.Size()); !strings.Contains(d, "size went from 7 to 14") {
+		t.Errorf("detail = %q, want size change", d)
+	}
+	if d := changedWhileReading(f, pre, 3); d == "" {
+		t.Error("short read not reported as a change")
+	}
+}
+
+func TestSpoolStable(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.txt")
+	os.WriteFile(path, []byte("stable contents"), 0644)
+	f, _ := os.Open(path)
+	defer f.Close()
+	spool, _ := os.Create(filepath.Join(dir, "spool"))
+	defer spool.Close()
+
+	// Leftover bytes from a previous, longer file must not survive.
+	spool.WriteString("previous spool contents that are longer")
+
+	attempts, detail, err := spoolStable(f, spool, 3)
+	if err != nil {
+		t.Fatalf("spoolStable: %v", err)
+	}
+	if attempts != 1 || detail != "" {
+		t.Errorf("attempts=%d detail=%q, want 1 and consistent", attempts, detail)
+	}
+	got, _ := os.ReadFile(spool.Name())
+	if string(got) != "stable contents" {
+		t.Errorf("spool = %q", got)
+	}
+}
+
+func TestReadStable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	os.WriteFile(path, []byte("stable contents"), 0644)
+	f, _ := os.Open(path)
+	defer f.Close()
+	f.Seek(4, io.SeekStart)
+
+	detail, err := readStable(f)
+	if err != nil || detail != "" {
+		t.Fatalf("readStable = %q, %v; want a stable file", detail, err)
+	}
+	// The file is left at the start, ready to be archived.
+	if got, _ := io.ReadAll(f); string(got) != "stable contents" {
+		t.Errorf("read after readStable = %q", got)
+	}
+}
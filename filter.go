@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+)
+
+// ExtractOptions selects which archive entries ExtractArchive writes,
+// where, and what happens to files already there. Patterns are matched
+// against entry names as stored in the archive (e.g.
+// etc-pihole/pihole-FTL.conf); see matchPattern.
+type ExtractOptions struct {
+	// Files are entries that must be in the archive: extraction fails,
+	// after writing everything else, if one matches nothing.
+	Files []string
+	// Include restricts extraction to matching entries. With neither Files
+	// nor Include set, everything is extracted.
+	Include []string
+	// Exclude skips matching entries, even ones selected by Files or
+	// Include.
+	Exclude []string
+	// StripComponents removes this many leading path components from each
+	// entry's name before writing it, like tar --strip-components. Entries
+	// with no components left are skipped.
+	StripComponents int
+	// OnConflict is what to do with entries whose path already exists:
+	// one of the Conflict* policies, ConflictOverwrite if empty.
+	OnConflict string
+	// DryRun logs what would be created, overwritten, skipped or removed
+	// without writing anything.
+	DryRun bool
+	// PreserveSpecial keeps set-user-ID and set-group-ID bits, which are
+	// dropped by default.
+	PreserveSpecial bool
+	// MaxSize and MaxEntries fail the extraction once the entries it
+	// writes hold more than MaxSize bytes or number more than MaxEntries.
+	// Zero means no limit.
+	MaxSize    int64
+	MaxEntries int
+}
+
+// matchPattern reports whether the archive entry name is selected by
+// pattern. A pattern matches an entry, or any directory above it, either
+// exactly or as a path.Match glob, so a directory selects everything in
+// it. A pattern without a slash is also matched against the base name of
+// each, so *.yaml selects YAML files at any depth.
+func matchPattern(pattern, name string) bool {
+	pattern = strings.TrimSuffix(pattern, "/")
+	hasSlash := strings.Contains(pattern, "/")
+	for p := strings.TrimSuffix(name, "/"); p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+		if !hasSlash {
+			if ok, _ := path.Match(pattern, path.Base(p)); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// entryFilter applies ExtractOptions to a stream of entry names and keeps
+// track of which patterns were used.
+type entryFilter struct {
+	opts ExtractOptions
+	used map[string]bool // keyed by flag name and pattern
+}
+
+func newEntryFilter(opts ExtractOptions) (*entryFilter, error) {
+	if opts.StripComponents < 0 {
+		return nil, fmt.Errorf("strip-components must not be negative")
+	}
+	for _, list := range [][]string{opts.Files, opts.Include, opts.Exclude} {
+		for _, p := range list {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("bad pattern %q: %w", p, err)
+			}
+		}
+	}
+	return &entryFilter{opts: opts, used: map[string]bool{}}, nil
+}
+
+// target returns the path, relative to the destination, that the entry
+// name should be written to, or false if it shouldn't be extracted.
+func (f *entryFilter) target(name string) (string, bool) {
+	if f.matchAny("exclude", f.opts.Exclude, name) {
+		return "", false
+	}
+	if len(f.opts.Files) > 0 || len(f.opts.Include) > 0 {
+		// Both lists are checked so each records its matches.
+		file := f.matchAny("file", f.opts.Files, name)
+		include := f.matchAny("include", f.opts.Include, name)
+		if !file && !include {
+			return "", false
+		}
+	}
+
+	if n := f.opts.StripComponents; n > 0 {
+		parts := strings.Split(strings.Trim(path.Clean(name), "/"), "/")
+		if len(parts) <= n {
+			return "", false
+		}
+		name = path.Join(parts[n:]...)
+	}
+	return name, true
+}
+
+// matchAny reports whether any of patterns matches name, recording each
+// one that does.
+func (f *entryFilter) matchAny(flag string, patterns []string, name string) bool {
+	matched := false
+	for _, p := range patterns {
+		if matchPattern(p, name) {
+			f.used[flag+"\x00"+p] = true
+			matched = true
+		}
+	}
+	return matched
+}
+
+// unused returns the patterns of the given flag that matched nothing.
+func (f *entryFilter) unused(flag string, patterns []string) []string {
+	var out []string
+	for _, p := range patterns {
+		if !f.used[flag+"\x00"+p] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// finish reports the patterns that matched nothing: a warning for
+// --include and --exclude, and an error for --file.
+func (f *entryFilter) finish() error {
+	for _, p := range f.unused("include", f.opts.Include) {
+		log.Printf("warning: --include %q matched nothing in the archive", p)
+	}
+	for _, p := range f.unused("exclude", f.opts.Exclude) {
+		log.Printf("warning: --exclude %q matched nothing in the archive", p)
+	}
+	if missing := f.unused("file", f.opts.Files); len(missing) > 0 {
+		quoted := make([]string, len(missing))
+		for i, p := range missing {
+			quoted[i] = fmt.Sprintf("%q", p)
+		}
+		return fmt.Errorf("file %s not found in archive", strings.Join(quoted, ", "))
+	}
+	return nil
+}
+
+// stringsFlag is a flag.Value collecting every use of a repeatable flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string { return strings.Join(*s, ",") }
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
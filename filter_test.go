@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"data/a.txt", "data/a.txt", true},
+		{"data/a.txt", "data/a.txt.bak", false},
+		{"data/config", "data/config/x.yaml", true},
+		{"data/config/", "data/config/.storage/auth", true},
+		{"data/config/", "data/config", true},
+		{"data/conf", "data/config/x.yaml", false},
+		{"*.yaml", "data/config/x.yaml", true},
+		{"*.yaml", "data/config/x.yml", false},
+		{"data/*.yaml", "data/x.yaml", true},
+		{"data/*.yaml", "data/config/x.yaml", false},
+		{"data/*/.storage", "data/config/.storage/auth", true},
+		{".storage", "data/config/.storage/auth", true},
+	}
+	for _, tt := range tests {
+		if got := matchPattern(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchPattern(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+// extractTree archives a small tree and extracts it with opts, returning
+// the files written, relative to the destination.
+func extractTree(t *testing.T, opts ExtractOptions) ([]string, error) {
+	t.Helper()
+	dataDir := filepath.Join(t.TempDir(), "data")
+	for name, content := range map[string]string{
+		"a.yaml":                 "a",
+		"notes.txt":              "n",
+		"config/b.yaml":          "b",
+		"config/.storage/auth":   "auth",
+		"config/.storage/cache":  "cache",
+		"config/deep/c.yaml":     "c",
+		"config/deep/other.json": "o",
+	} {
+		p := filepath.Join(dataDir, name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		os.WriteFile(p, []byte(content), 0644)
+	}
+	var buf bytes.Buffer
+	if _, err := CreateArchive(&buf, dataDir, nil, nil, ArchiveOptions{}); err != nil {
+		t.Fatalf("CreateArchive: %v", err)
+	}
+
+	dest := t.TempDir()
+	err := ExtractArchive(&buf, dest, opts)
+	var files []string
+	filepath.Walk(dest, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			rel, _ := filepath.Rel(dest, p)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+func TestExtractArchiveFilters(t *testing.T) {
+	tests := []struct {
+		name string
+		opts ExtractOptions
+		want string
+	}{
+		{"subdirectory", ExtractOptions{Files: []string{"data/config/.storage/"}},
+			"data/config/.storage/auth data/config/.storage/cache"},
+		{"glob", ExtractOptions{Include: []string{"*.yaml"}},
+			"data/a.yaml data/config/b.yaml data/config/deep/c.yaml"},
+		{"several", ExtractOptions{Files: []string{"data/notes.txt", "data/config/deep"}},
+			"data/config/deep/c.yaml data/config/deep/other.json data/notes.txt"},
+		{"exclude", ExtractOptions{Include: []string{"data/config"}, Exclude: []string{".storage", "*.json"}},
+			"data/config/b.yaml data/config/deep/c.yaml"},
+		{"strip", ExtractOptions{Files: []string{"data/config/.storage"}, StripComponents: 2},
+			".storage/auth .storage/cache"},
+	}
+	for _, tt := range tests {
+		files, err := extractTree(t, tt.opts)
+		if err != nil {
+			t.Errorf("%s: ExtractArchive: %v", tt.name, err)
+			continue
+		}
+		if got := strings.Join(files, " "); got != tt.want {
+			t.Errorf("%s: extracted %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExtractArchiveReportsUnmatchedPatterns(t *testing.T) {
+	logs := captureLog(t)
+	files, err := extractTree(t, ExtractOptions{
+		Files:   []string{"data/a.yaml", "data/missing", "*.toml"},
+		Include: []string{"*.ini"},
+		Exclude: []string{"*.bak"},
+	})
+
+	// Everything that did match is still extracted.
+	if len(files) != 1 || files[0] != "data/a.yaml" {
+		t.Errorf("extracted %v, want [data/a.yaml]", files)
+	}
+	if err == nil || !strings.Contains(err.Error(), `"data/missing", "*.toml" not found in archive`) {
+		t.Errorf("err = %v, want the unmatched --file patterns", err)
+	}
+	for _, want := range []string{`--include "*.ini" matched nothing`, `--exclude "*.bak" matched nothing`} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("log missing %q:\n%s", want, logs)
+		}
+	}
+}
+
+func TestExtractArchiveRejectsBadPattern(t *testing.T) {
+	if _, err := extractTree(t, ExtractOptions{Include: []string{"data/["}}); err == nil {
+		t.Error("want error for malformed glob")
+	}
+}
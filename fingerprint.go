@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// fingerprintVersion is mixed into every fingerprint so a release that
+// changes how archives are built doesn't match fingerprints from older ones.
+const fingerprintVersion = "pi-backup fingerprint v1"
+
+// defaultDeepCheckInterval is how often a directory is archived and
+// hashed in full even when its fingerprint hasn't changed.
+const defaultDeepCheckInterval = 7 * 24 * time.Hour
+
+// TreeFingerprint returns a cheap digest of what CreateArchive would
+// archive for the same arguments, without reading file contents: each
+// entry's path, type, mode, owner, size, mtime and inode, and the target of
+// each symlink. Files with an override (SQLite snapshots) are hashed by the
+// override's contents instead, since their live metadata says nothing about
+// the snapshot.
+//
+// A matching fingerprint means the archive would almost certainly be
+// unchanged; it can miss a rewrite that keeps the same size and mtime,
+// which is what the periodic deep check is for. Any error reading the tree
+// is returned, and the caller should fall back to archiving.
+func TreeFingerprint(dir string, overrides map[string]string, excludes map[string]bool, opts ArchiveOptions) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%+v\n", fingerprintVersion, opts)
+
+	err := walkTree(dir, opts, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if excludes[path] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		mode := info.Mode()
+		if mode&os.ModeSocket != 0 || mode&os.ModeDevice != 0 || mode&os.ModeCharDevice != 0 {
+			return nil
+		}
+
+		rel, err := filepath.Rel(filepath.Dir(dir), path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%q %o", rel, uint32(mode))
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			fmt.Fprintf(h, " %d:%d", st.Uid, st.Gid)
+		}
+
+		if src, ok := overrides[path]; ok {
+			// Mode and mtime still come from the live file; see
+			// CreateArchive.
+			fmt.Fprintf(h, " %d override ", info.ModTime().UnixNano())
+			if err := hashFile(h, src); err != nil {
+				return fmt.Errorf("hashing %s: %w", src, err)
+			}
+			h.Write([]byte("\n"))
+			return nil
+		}
+
+		mtime := info.ModTime().UnixNano()
+		if info.IsDir() {
+			// Opening a SQLite database creates and removes its -wal and
+			// -shm files, so directory mtimes move on every run. The
+			// archive only keeps them to the second; do the same.
+			mtime = info.ModTime().Unix()
+		}
+		fmt.Fprintf(h, " %d %d", info.Size(), mtime)
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			fmt.Fprintf(h, " %d:%d", st.Dev, st.Ino)
+		}
+		if mode&os.ModeSymlink != 0 {
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, " -> %q", link)
+		}
+		h.Write([]byte("\n"))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// hashFile writes the SHA-256 hex digest of the file at path to w.
+func hashFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fh := sha256.New()
+	if _, err := io.Copy(fh, f); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%x", fh.Sum(nil))
+	return err
+}
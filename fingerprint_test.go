@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTreeFingerprint(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "data")
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0644)
+	os.WriteFile(filepath.Join(dir, "sub", "b.txt"), []byte("world"), 0644)
+	os.WriteFile(filepath.Join(dir, "skip.log"), []byte("noise"), 0644)
+	excludes := map[string]bool{filepath.Join(dir, "skip.log"): true}
+
+	fp := func() string {
+		t.Helper()
+		got, err := TreeFingerprint(dir, nil, excludes, ArchiveOptions{})
+		if err != nil {
+			t.Fatalf("TreeFingerprint: %v", err)
+		}
+		return got
+	}
+	base := fp()
+	if again := fp(); again != base {
+		t.Fatal("fingerprint of an unchanged tree changed")
+	}
+
+	os.WriteFile(filepath.Join(dir, "skip.log"), []byte("more noise"), 0644)
+	if got := fp(); got != base {
+		t.Error("changing an excluded file changed the fingerprint")
+	}
+
+	// Same size, same mtime: invisible to the fingerprint by design.
+	b := filepath.Join(dir, "sub", "b.txt")
+	info, _ := os.Stat(b)
+	os.WriteFile(b, []byte("WORLD"), 0644)
+	os.Chtimes(b, info.ModTime(), info.ModTime())
+	if got := fp(); got != base {
+		t.Error("a same-size, same-mtime rewrite changed the fingerprint")
+	}
+
+	os.Chtimes(b, info.ModTime(), info.ModTime().Add(time.Second))
+	touched := fp()
+	if touched == base {
+		t.Error("changing an mtime didn't change the fingerprint")
+	}
+
+	os.Chmod(b, 0600)
+	if got := fp(); got == touched {
+		t.Error("changing a mode didn't change the fingerprint")
+	}
+
+	os.WriteFile(filepath.Join(dir, "new.txt"), nil, 0644)
+	if got := fp(); got == touched {
+		t.Error("adding a file didn't change the fingerprint")
+	}
+}
+
+func TestTreeFingerprintOverrides(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "data")
+	os.MkdirAll(dir, 0755)
+	live := filepath.Join(dir, "app.db")
+	os.WriteFile(live, []byte("live"), 0644)
+	snap := filepath.Join(root, "snap.db")
+	os.WriteFile(snap, []byte("snapshot one"), 0644)
+	overrides := map[string]string{live: snap}
+
+	first, err := TreeFingerprint(dir, overrides, nil, ArchiveOptions{})
+	if err != nil {
+		t.Fatalf("TreeFingerprint: %v", err)
+	}
+	os.WriteFile(snap, []byte("snapshot two"), 0644)
+	second, err := TreeFingerprint(dir, overrides, nil, ArchiveOptions{})
+	if err != nil {
+		t.Fatalf("TreeFingerprint: %v", err)
+	}
+	if first == second {
+		t.Error("changing a snapshot's contents didn't change the fingerprint")
+	}
+}
+
+func TestCreateArchiveWithHashSkipsOnFingerprint(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	os.MkdirAll(dir, 0755)
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0644)
+	makeSqliteDB(t, filepath.Join(dir, "app.db"))
+	d := Directory{Path: dir, SqliteFiles: []string{"app.db"}}
+	ctx := context.Background()
+
+	// Hold the database open like the application would, so its -wal and
+	// -shm files (and so the directory's mtime) stay put between runs.
+	db, err := sql.Open("sqlite", filepath.Join(dir, "app.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("SELECT count(*) FROM t"); err != nil {
+		t.Fatal(err)
+	}
+
+	path, hash, fingerprint, _, err := createArchiveWithHash(ctx, d, "")
+	if err != nil {
+		t.Fatalf("createArchiveWithHash: %v", err)
+	}
+	os.Remove(path)
+	if hash == "" || fingerprint == "" {
+		t.Fatalf("hash = %q, fingerprint = %q", hash, fingerprint)
+	}
+
+	path, _, again, _, err := createArchiveWithHash(ctx, d, fingerprint)
+	if err != nil {
+		t.Fatalf("createArchiveWithHash: %v", err)
+	}
+	if path != "" {
+		os.Remove(path)
+		t.Error("archived a directory whose fingerprint matched")
+	}
+	if again != fingerprint {
+		t.Errorf("fingerprint changed from %s to %s", fingerprint, again)
+	}
+
+	// A write to the database shows up through its snapshot.
+	if _, err := db.Exec("INSERT INTO t (v) VALUES ('again')"); err != nil {
+		t.Fatal(err)
+	}
+
+	path, _, _, _, err = createArchiveWithHash(ctx, d, fingerprint)
+	if err != nil {
+		t.Fatalf("createArchiveWithHash: %v", err)
+	}
+	if path == "" {
+		t.Fatal("skipped a directory whose database changed")
+	}
+	os.Remove(path)
+}
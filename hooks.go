@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// defaultHookTimeout bounds hooks that don't set their own timeout.
+const defaultHookTimeout = 10 * time.Minute
+
+// on_failure policies for hooks.
+const (
+	HookAbort    = "abort"
+	HookContinue = "continue"
+)
+
+// Hook is a shell command run before or after a backup or restore.
+type Hook struct {
+	Command   string        `yaml:"command"`
+	Timeout   time.Duration `yaml:"timeout,omitempty"`
+	OnFailure string        `yaml:"on_failure,omitempty"` // "abort" (default) or "continue"
+}
+
+// Hooks groups the commands run around backups and restores, either for the
+// whole run (Config.Hooks) or for a single directory (Directory.Hooks).
+type Hooks struct {
+	PreBackup   []Hook `yaml:"pre_backup,omitempty"`
+	PostBackup  []Hook `yaml:"post_backup,omitempty"`
+	PreRestore  []Hook `yaml:"pre_restore,omitempty"`
+	PostRestore []Hook `yaml:"post_restore,omitempty"`
+}
+
+// validate checks every hook in h. field names the hooks block in errors.
+func (h Hooks) validate(field string) error {
+	for phase, hooks := range map[string][]Hook{
+		"pre_backup":   h.PreBackup,
+		"post_backup":  h.PostBackup,
+		"pre_restore":  h.PreRestore,
+		"post_restore": h.PostRestore,
+	} {
+		for i, hook := range hooks {
+			if strings.TrimSpace(hook.Command) == "" {
+				return fmt.Errorf("config: %s.%s[%d].command is required", field, phase, i)
+			}
+			if hook.Timeout < 0 {
+				return fmt.Errorf("config: %s.%s[%d].timeout must not be negative", field, phase, i)
+			}
+			switch hook.OnFailure {
+			case "", HookAbort, HookContinue:
+			default:
+				return fmt.Errorf("config: %s.%s[%d].on_failure: must be %q or %q, got %q", field, phase, i, HookAbort, HookContinue, hook.OnFailure)
+			}
+		}
+	}
+	return nil
+}
+
+// HookEnv describes the run to hook commands. It is passed as PI_BACKUP_*
+// environment variables; empty fields are left unset.
+type HookEnv struct {
+	Phase     string // pre_backup, post_backup, pre_restore or post_restore
+	Hostname  string
+	Bucket    string
+	Directory string // set for per-directory hooks
+	Key       string // S3 key being written or restored
+	Dest      string // restore destination
+	DryRun    bool
+	Status    string // post hooks: "success" or "failure"
+	Error     string // post hooks: the failure, if any
+}
+
+func (e HookEnv) environ() []string {
+	env := os.Environ()
+	add := func(k, v string) {
+		if v != "" {
+			env = append(env, "PI_BACKUP_"+k+"="+v)
+		}
+	}
+	add("PHASE", e.Phase)
+	add("HOSTNAME", e.Hostname)
+	add("BUCKET", e.Bucket)
+	add("DIRECTORY", e.Directory)
+	add("KEY", e.Key)
+	add("DEST", e.Dest)
+	if e.DryRun {
+		add("DRY_RUN", "1")
+	}
+	add("STATUS", e.Status)
+	add("ERROR", e.Error)
+	return env
+}
+
+// withResult returns a copy of e for a post hook following an operation
+// that ended with err.
+func (e HookEnv) withResult(phase string, err error) HookEnv {
+	e.Phase = phase
+	e.Status = "success"
+	e.Error = ""
+	if err != nil {
+		e.Status = "failure"
+		e.Error = err.Error()
+	}
+	return e
+}
+
+// RunHooks runs hooks in order with env. A failing hook whose on_failure is
+// "continue" is logged and skipped; one whose on_failure is "abort" stops
+// the remaining hooks and its error is returned.
+func RunHooks(ctx context.Context, hooks []Hook, env HookEnv) error {
+	for _, h := range hooks {
+		if env.DryRun {
+			log.Printf("[dry-run] would run %s hook: %s", env.Phase, h.Command)
+			continue
+		}
+		err := runHook(ctx, h, env)
+		if err == nil {
+			continue
+		}
+		if h.OnFailure == HookContinue {
+			log.Printf("warning: %s hook %q failed (continuing): %v", env.Phase, h.Command, err)
+			continue
+		}
+		return fmt.Errorf("%s hook %q: %w", env.Phase, h.Command, err)
+	}
+	return nil
+}
+
+// runHook runs a single hook through /bin/sh and logs its output.
+func runHook(ctx context.Context, h Hook, env HookEnv) error {
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	log.Printf("running %s hook: %s", env.Phase, h.Command)
+	var out bytes.Buffer
+	cmd := shellCommand(ctx, h.Command)
+	cmd.Env = env.environ()
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	err := cmd.Run()
+	for _, line := range strings.Split(strings.TrimRight(out.String(), "\n"), "\n") {
+		if line != "" {
+			log.Printf("  [%s] %s", env.Phase, line)
+		}
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	return err
+}
+
+// shellCommand returns a /bin/sh -c command bound to ctx. It runs in its own
+// process group, and cancelling ctx kills the whole group so anything the
+// command started doesn't linger.
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = 5 * time.Second
+	return cmd
+}
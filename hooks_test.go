@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunHooksEnvironment(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "env.txt")
+	hooks := []Hook{{Command: `env | grep ^PI_BACKUP_ | sort > "` + out + `"`}}
+	env := HookEnv{
+		Phase:     "post_backup",
+		Hostname:  "cherry",
+		Bucket:    "b",
+		Directory: "/opt/x",
+		Key:       "cherry/opt-x/ts.tar.gz",
+		Status:    "failure",
+		Error:     "boom",
+	}
+	if err := RunHooks(context.Background(), hooks, env); err != nil {
+		t.Fatalf("RunHooks: %v", err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("reading hook output: %v", err)
+	}
+	for _, want := range []string{
+		"PI_BACKUP_PHASE=post_backup",
+		"PI_BACKUP_HOSTNAME=cherry",
+		"PI_BACKUP_DIRECTORY=/opt/x",
+		"PI_BACKUP_KEY=cherry/opt-x/ts.tar.gz",
+		"PI_BACKUP_STATUS=failure",
+		"PI_BACKUP_ERROR=boom",
+	} {
+		if !strings.Contains(string(data), want+"\n") {
+			t.Errorf("hook env missing %s; got:\n%s", want, data)
+		}
+	}
+	if strings.Contains(string(data), "PI_BACKUP_DEST=") {
+		t.Error("empty fields should not be exported")
+	}
+}
+
+func TestRunHooksOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "ran")
+	env := HookEnv{Phase: "pre_backup"}
+
+	hooks := []Hook{
+		{Command: "exit 1", OnFailure: HookContinue},
+		{Command: "touch " + marker},
+	}
+	if err := RunHooks(context.Background(), hooks, env); err != nil {
+		t.Fatalf("continue hook should not fail the run: %v", err)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Error("hook after a continue-on-failure hook did not run")
+	}
+
+	os.Remove(marker)
+	hooks[0].OnFailure = ""
+	if err := RunHooks(context.Background(), hooks, env); err == nil {
+		t.Fatal("expected abort hook failure to be returned")
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Error("hooks after an aborting failure should not run")
+	}
+}
+
+func TestRunHooksTimeout(t *testing.T) {
+	start := time.Now()
+	err := RunHooks(context.Background(), []Hook{{Command: "sleep 30 & sleep 30", Timeout: 200 * time.Millisecond}}, HookEnv{Phase: "pre_backup"})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("err = %v, want timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("timeout took %s; process group not killed?", elapsed)
+	}
+}
+
+func TestRunHooksDryRun(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "ran")
+	err := RunHooks(context.Background(), []Hook{{Command: "touch " + marker}}, HookEnv{Phase: "pre_backup", DryRun: true})
+	if err != nil {
+		t.Fatalf("RunHooks: %v", err)
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Error("hook ran in dry-run mode")
+	}
+}
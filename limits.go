@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultMaxEntries bounds the number of entries a restore extracts when
+// restore_limits doesn't set max_entries.
+const defaultMaxEntries = 1_000_000
+
+// RestoreLimits bounds what a restore will extract from one archive, so a
+// corrupt or hostile archive can't fill the disk or inode table.
+type RestoreLimits struct {
+	MaxSize    ByteSize `yaml:"max_size,omitempty"`    // total bytes of file contents; unlimited if zero
+	MaxEntries int      `yaml:"max_entries,omitempty"` // files, directories and links; default 1,000,000
+}
+
+func (l RestoreLimits) validate() error {
+	if l.MaxSize < 0 {
+		return fmt.Errorf("config: restore_limits.max_size must not be negative")
+	}
+	if l.MaxEntries < 0 {
+		return fmt.Errorf("config: restore_limits.max_entries must not be negative")
+	}
+	return nil
+}
+
+// ExtractOptions returns the extract options every restore starts from:
+// the configured limits, with defaults filled in.
+func (c *Config) ExtractOptions() ExtractOptions {
+	opts := ExtractOptions{
+		MaxSize:    int64(c.RestoreLimits.MaxSize),
+		MaxEntries: c.RestoreLimits.MaxEntries,
+	}
+	if opts.MaxEntries == 0 {
+		opts.MaxEntries = defaultMaxEntries
+	}
+	return opts
+}
+
+// ByteSize is a number of bytes, written in the config and on the command
+// line as a plain number or with a binary K, M, G or T suffix (e.g. 10G).
+type ByteSize int64
+
+// ParseByteSize parses a ByteSize.
+func ParseByteSize(s string) (ByteSize, error) {
+	t := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	t = strings.TrimSuffix(t, "I")
+	mult := int64(1)
+	if n := len(t); n > 0 {
+		switch t[n-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			t = t[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || n < 0 || n > (1<<63-1)/mult {
+		return 0, fmt.Errorf("bad size %q: want e.g. 500M or 10G", s)
+	}
+	return ByteSize(n * mult), nil
+}
+
+func (b *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	v, err := ParseByteSize(value.Value)
+	if err != nil {
+		return err
+	}
+	*b = v
+	return nil
+}
+
+// String and Set make *ByteSize a flag.Value.
+func (b *ByteSize) String() string { return strconv.FormatInt(int64(*b), 10) }
+
+func (b *ByteSize) Set(s string) error {
+	v, err := ParseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = v
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want ByteSize
+	}{
+		{"0", 0},
+		{"512", 512},
+		{"10K", 10 << 10},
+		{"500M", 500 << 20},
+		{"10G", 10 << 30},
+		{"2T", 2 << 40},
+		{"10g", 10 << 30},
+		{"10GB", 10 << 30},
+		{"10GiB", 10 << 30},
+		{" 1M ", 1 << 20},
+	}
+	for _, tt := range tests {
+		got, err := ParseByteSize(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseByteSize(%q) = %d, %v; want %d", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"", "G", "-1", "1.5G", "10X", "9999999999T"} {
+		if _, err := ParseByteSize(in); err == nil {
+			t.Errorf("ParseByteSize(%q) succeeded, want an error", in)
+		}
+	}
+}
+
+func TestConfigExtractOptions(t *testing.T) {
+	var cfg Config
+	if err := yaml.Unmarshal([]byte("restore_limits:\n  max_size: 2G\n"), &cfg); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	opts := cfg.ExtractOptions()
+	if opts.MaxSize != 2<<30 {
+		t.Errorf("MaxSize = %d, want %d", opts.MaxSize, 2<<30)
+	}
+	if opts.MaxEntries != defaultMaxEntries {
+		t.Errorf("MaxEntries = %d, want the default %d", opts.MaxEntries, defaultMaxEntries)
+	}
+
+	cfg.RestoreLimits.MaxEntries = 10
+	if got := cfg.ExtractOptions().MaxEntries; got != 10 {
+		t.Errorf("MaxEntries = %d, want 10", got)
+	}
+}
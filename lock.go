@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// lockFileName is the run lock, kept next to the config file.
+const lockFileName = "pi-backup.lock"
+
+// lockPollInterval is how often a waiting run retries the lock.
+const lockPollInterval = 500 * time.Millisecond
+
+// LockOptions says whether to wait for a lock another run holds.
+type LockOptions struct {
+	Wait    bool
+	Timeout time.Duration // with Wait, give up after this long; 0 waits forever
+}
+
+// addLockFlags registers --wait and --wait-timeout on fs.
+func addLockFlags(fs *flag.FlagSet) *LockOptions {
+	o := &LockOptions{}
+	fs.BoolVar(&o.Wait, "wait", false, "wait for another pi-backup run to finish instead of failing")
+	fs.DurationVar(&o.Timeout, "wait-timeout", 0, "with --wait, give up after this long (e.g. 30m; default: wait forever)")
+	return o
+}
+
+// LockPath returns the path of the run lock for the config at configPath.
+func LockPath(configPath string) string {
+	return filepath.Join(filepath.Dir(configPath), lockFileName)
+}
+
+// RunLock is an exclusive flock held for the length of a backup, prune or
+// restore, so runs never overlap.
+type RunLock struct {
+	f *os.File
+}
+
+// AcquireLock takes the exclusive lock at path for op (e.g. "backup").
+// If another run holds it, AcquireLock fails straight away naming that
+// run's PID, or with o.Wait polls until it is free or o.Timeout passes.
+//
+// The lock is released when the process exits, however it exits.
+func AcquireLock(path, op string, o LockOptions) (*RunLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening lock file: %w", err)
+	}
+
+	var deadline time.Time
+	if o.Timeout > 0 {
+		deadline = time.Now().Add(o.Timeout)
+	}
+	logged := false
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			f.Close()
+			return nil, fmt.Errorf("locking %s: %w", path, err)
+		}
+
+		holder := lockHolder(path)
+		if !o.Wait {
+			f.Close()
+			return nil, fmt.Errorf("another pi-backup run holds %s (%s); use --wait to wait for it", path, holder)
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("gave up after %s waiting for another pi-backup run to release %s (%s)", o.Timeout, path, holder)
+		}
+		if !logged {
+			log.Printf("waiting for another pi-backup run to release %s (%s)", path, holder)
+			logged = true
+		}
+		time.Sleep(lockPollInterval)
+	}
+
+	// Record who holds the lock for anyone who finds it taken.
+	info := fmt.Sprintf("pid %d, %s started %s\n", os.Getpid(), op, time.Now().UTC().Format(time.RFC3339))
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(info), 0)
+	}
+	return &RunLock{f: f}, nil
+}
+
+// Release clears and unlocks the lock file. The file itself is left in
+// place: removing it would let two runs lock different files.
+func (l *RunLock) Release() error {
+	l.f.Truncate(0)
+	return l.f.Close()
+}
+
+// lockHolder describes the run holding the lock at path from what it wrote
+// there.
+func lockHolder(path string) string {
+	data, err := os.ReadFile(path)
+	if s := strings.TrimSpace(string(data)); err == nil && s != "" {
+		return s
+	}
+	return "pid unknown"
+}
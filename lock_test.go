@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcquireLockExclusive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), lockFileName)
+
+	lock, err := AcquireLock(path, "backup", LockOptions{})
+	if err != nil {
+		t.Fatalf("AcquireLock: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	if want := fmt.Sprintf("pid %d, backup started", os.Getpid()); !strings.HasPrefix(string(data), want) {
+		t.Errorf("lock file = %q, want prefix %q", data, want)
+	}
+
+	_, err = AcquireLock(path, "restore", LockOptions{})
+	if err == nil {
+		t.Fatal("second AcquireLock succeeded while the lock was held")
+	}
+	if want := fmt.Sprintf("pid %d", os.Getpid()); !strings.Contains(err.Error(), want) {
+		t.Errorf("error %q doesn't name the holder (%s)", err, want)
+	}
+
+	if err := lock.Release(); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	lock, err = AcquireLock(path, "restore", LockOptions{})
+	if err != nil {
+		t.Fatalf("AcquireLock after Release: %v", err)
+	}
+	lock.Release()
+}
+
+func TestAcquireLockWaitTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), lockFileName)
+	lock, err := AcquireLock(path, "backup", LockOptions{})
+	if err != nil {
+		t.Fatalf("AcquireLock: %v", err)
+	}
+	defer lock.Release()
+
+	start := time.Now()
+	_, err = AcquireLock(path, "prune", LockOptions{Wait: true, Timeout: time.Second})
+	if err == nil || !strings.Contains(err.Error(), "gave up") {
+		t.Fatalf("err = %v, want timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("gave up after %s, want at least 1s", elapsed)
+	}
+}
+
+func TestAcquireLockWaitsForRelease(t *testing.T) {
+	path := filepath.Join(t.TempDir(), lockFileName)
+	lock, err := AcquireLock(path, "backup", LockOptions{})
+	if err != nil {
+		t.Fatalf("AcquireLock: %v", err)
+	}
+	time.AfterFunc(200*time.Millisecond, func() { lock.Release() })
+
+	second, err := AcquireLock(path, "restore", LockOptions{Wait: true, Timeout: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("AcquireLock with --wait: %v", err)
+	}
+	second.Release()
+}
@@ -3,17 +3,52 @@ package main
 import (
 	"context"
 	"crypto/sha256"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"path/filepath"
 	"time"
 )
 
 var version = "dev"
 
+// exitPartial is the exit status of a run in which every directory was
+// backed up but some entries were skipped under on_error: skip.
+const exitPartial = 3
+
+// dirReport pairs a backup source (a directory or command source ID) with
+// anything its archive had to work around: skipped entries and files that
+// changed while being read.
+type dirReport struct {
+	Path string
+	ArchiveReport
+}
+
+// subcommands are the commands other than a backup, by name. Each is
+// called with the loaded config, its path and the arguments after the name.
+var subcommands = map[string]func(cfg *Config, configPath string, args []string){
+	"restore":      runRestore,
+	"prune":        runPrune,
+	"migrate-host": runMigrateHost,
+	"diff":         func(cfg *Config, _ string, args []string) { runDiff(cfg, args) },
+	"state":        runState,
+}
+
+// loadConfigWithCredentials loads the config at path and checks that AWS
+// credentials are set, exiting if either fails.
+func loadConfigWithCredentials(path string) *Config {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" || os.Getenv("AWS_SECRET_ACCESS_KEY") == "" {
+		log.Fatal("error: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return cfg
+}
+
 func main() {
 	log.SetFlags(0) // systemd/journald adds its own timestamps
 
@@ -36,145 +71,429 @@ func main() {
 		}
 	}
 
-	// Route to restore subcommand
-	if len(restArgs) > 0 && restArgs[0] == "restore" {
-		cfg, err := LoadConfig(configPath)
-		if err != nil {
-			log.Fatalf("error: %v", err)
-		}
-		if os.Getenv("AWS_ACCESS_KEY_ID") == "" || os.Getenv("AWS_SECRET_ACCESS_KEY") == "" {
-			log.Fatal("error: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	// Route to a subcommand
+	if len(restArgs) > 0 {
+		if run, ok := subcommands[restArgs[0]]; ok {
+			run(loadConfigWithCredentials(configPath), configPath, restArgs[1:])
+			return
 		}
-		runRestore(cfg, restArgs[1:])
-		return
 	}
 
 	// Default: backup mode (use flag package for remaining flags)
 	fs := flag.NewFlagSet("backup", flag.ExitOnError)
 	dryRun := fs.Bool("dry-run", false, "log planned uploads without uploading")
+	deepCheck := fs.Bool("deep-check", false, "archive and hash every directory even if its fingerprint is unchanged")
+	lockOpts := addLockFlags(fs)
 	fs.Parse(restArgs)
 
-	cfg, err := LoadConfig(configPath)
+	cfg := loadConfigWithCredentials(configPath)
+
+	lock, err := AcquireLock(LockPath(configPath), "backup", *lockOpts)
 	if err != nil {
 		log.Fatalf("error: %v", err)
 	}
+	defer lock.Release()
 
-	// Verify AWS credentials are present before starting
-	if os.Getenv("AWS_ACCESS_KEY_ID") == "" || os.Getenv("AWS_SECRET_ACCESS_KEY") == "" {
-		log.Fatal("error: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	statePath := StatePath(configPath)
+	state, err := LoadState(statePath)
+	if err != nil {
+		log.Fatalf("error loading state: %v", err)
+	}
+	if cfg.VerifyRemote {
+		VerifyState(context.Background(), cfg, state)
 	}
 
-	now := time.Now()
+	run := &backupRun{
+		cfg:       cfg,
+		now:       time.Now(),
+		dryRun:    *dryRun,
+		deepCheck: *deepCheck,
+		statePath: statePath,
+		state:     state,
+	}
 	ctx := context.Background()
 	var failed []string
-
-	checksumsPath := filepath.Join(filepath.Dir(configPath), "checksums.json")
-	checksums, err := LoadChecksums(checksumsPath)
-	if err != nil {
-		log.Fatalf("error loading checksums: %v", err)
+	var reports []dirReport
+	addReport := func(source string, report ArchiveReport) {
+		if len(report.Skipped) > 0 || len(report.ZeroFilled) > 0 || len(report.Changed) > 0 {
+			reports = append(reports, dirReport{Path: source, ArchiveReport: report})
+		}
 	}
 
-	for _, d := range cfg.Directories {
-		key := S3Key(cfg.Hostname, d.Path, now)
-		slug := PathSlug(d.Path)
+	runEnv := HookEnv{Phase: "pre_backup", Hostname: cfg.Hostname, Bucket: cfg.Bucket, DryRun: *dryRun}
+	runErr := RunHooks(ctx, cfg.Hooks.PreBackup, runEnv)
+	if runErr != nil {
+		log.Printf("error: %v; not backing up any directories", runErr)
+	} else {
+		for _, d := range cfg.Directories {
+			key := S3Key(cfg.Hostname, d.Path, run.now)
+			env := runEnv
+			env.Directory = d.Path
+			env.Key = key
 
-		archivePath, hash, err := createArchiveWithHash(d)
-		if err != nil {
-			log.Printf("error creating archive for %s: %v", d.Path, err)
-			failed = append(failed, d.Path)
-			continue
+			// Post hooks run whatever happened, so anything a pre hook
+			// stopped gets started again.
+			var report ArchiveReport
+			err := RunHooks(ctx, d.Hooks.PreBackup, env)
+			if err == nil {
+				report, err = run.backupSource(ctx, d.Path, key, func(prevFingerprint string) (string, string, string, ArchiveReport, error) {
+					if run.dryRun && d.Docker != nil {
+						log.Printf("[dry-run] would %s containers %v while archiving %s", d.Docker.action(), d.Docker.Containers, d.Path)
+						d.Docker = nil
+					}
+					return createArchiveWithHash(ctx, d, prevFingerprint)
+				})
+			}
+			if herr := RunHooks(ctx, d.Hooks.PostBackup, env.withResult("post_backup", err)); herr != nil && err == nil {
+				err = herr
+			}
+
+			addReport(d.Path, report)
+			if err != nil {
+				log.Printf("error backing up %s: %v", d.Path, err)
+				failed = append(failed, d.Path)
+				run.recordFailure(d.Path, err)
+			}
 		}
 
-		if checksums[slug] == hash {
-			if *dryRun {
-				log.Printf("[dry-run] would skip %s (unchanged)", d.Path)
-			} else {
-				log.Printf("skipping %s (unchanged)", d.Path)
+		for _, c := range cfg.Commands {
+			id := c.ID()
+			key := S3Key(cfg.Hostname, id, run.now)
+			report, err := run.backupSource(ctx, id, key, func(string) (string, string, string, ArchiveReport, error) {
+				// Command output can only be compared by running the
+				// commands, so command sources have no fingerprint.
+				path, hash, report, err := createCommandArchiveWithHash(ctx, c)
+				return path, hash, "", report, err
+			})
+			addReport(id, report)
+			if err != nil {
+				log.Printf("error backing up %s: %v", id, err)
+				failed = append(failed, id)
+				run.recordFailure(id, err)
 			}
-			os.Remove(archivePath)
-			continue
 		}
+	}
+
+	if runErr == nil && len(failed) > 0 {
+		runErr = fmt.Errorf("failed to back up %d directories: %v", len(failed), failed)
+	}
+	if err := RunHooks(ctx, cfg.Hooks.PostBackup, runEnv.withResult("post_backup", runErr)); err != nil {
+		log.Printf("error: %v", err)
+		if runErr == nil {
+			runErr = err
+		}
+	}
 
-		if *dryRun {
-			log.Printf("[dry-run] would upload %s -> s3://%s/%s", d.Path, cfg.Bucket, key)
-			os.Remove(archivePath)
-			continue
+	partial := 0
+	for _, r := range reports {
+		if len(r.Skipped) > 0 || len(r.ZeroFilled) > 0 {
+			partial++
 		}
+		if len(r.Skipped) > 0 {
+			log.Printf("%s: skipped %d unreadable entries:", r.Path, len(r.Skipped))
+			for _, e := range r.Skipped {
+				log.Printf("  %s: %v", e.Path, e.Err)
+			}
+		}
+		if len(r.ZeroFilled) > 0 {
+			log.Printf("%s: %d files couldn't be read in full and were archived zero-filled:", r.Path, len(r.ZeroFilled))
+			for _, e := range r.ZeroFilled {
+				log.Printf("  %s: zero-filled after %d bytes: %v", e.Path, e.Written, e.Err)
+			}
+		}
+		if len(r.Changed) > 0 {
+			log.Printf("%s: %d files changed while being archived and may be inconsistent:", r.Path, len(r.Changed))
+			for _, e := range r.Changed {
+				log.Printf("  %s: %s", e.Path, e.Detail)
+			}
+		}
+	}
+	if runErr != nil {
+		log.Fatalf("%v", runErr)
+	}
+	if partial > 0 {
+		log.Printf("partial success: %d directories backed up with skipped or zero-filled entries", partial)
+		os.Exit(exitPartial)
+	}
+}
+
+// backupRun carries what every directory in a backup run shares.
+type backupRun struct {
+	cfg       *Config
+	now       time.Time
+	dryRun    bool
+	deepCheck bool // archive every source in full, ignoring fingerprints
+	statePath string
+	state     *State
+}
 
-		log.Printf("backing up %s -> s3://%s/%s", d.Path, cfg.Bucket, key)
+// archiveFunc builds a temp archive of a backup source, as
+// createArchiveWithHash does for a directory, and returns the source's
+// fingerprint if it has one. If prevFingerprint is set and still matches,
+// it returns no path instead of archiving.
+type archiveFunc func(prevFingerprint string) (path string, hash string, fingerprint string, report ArchiveReport, err error)
 
-		if err := uploadArchive(ctx, cfg, key, archivePath); err != nil {
-			log.Printf("error backing up %s: %v", d.Path, err)
-			failed = append(failed, d.Path)
-			os.Remove(archivePath)
-			continue
+// backupSource archives a source (a directory path or a command source
+// ID) with create and uploads it to key unless it is unchanged since the
+// last upload: either its fingerprint matches, or the archive's hash does.
+// The archive report is returned even on failure so skipped and changed
+// entries are still listed.
+func (r *backupRun) backupSource(ctx context.Context, source, key string, create archiveFunc) (ArchiveReport, error) {
+	start := time.Now()
+
+	prev := r.state.Sources[PathSlug(source)]
+	// A source whose latest snapshot is too old is archived in full even
+	// if its fingerprint matches, so that if refreshing the snapshot by
+	// copy fails the archive is at hand to upload.
+	stale := r.snapshotStale(source, prev)
+	var prevFingerprint string
+	if prev != nil && prev.Hash != "" && !stale && !r.deepCheckDue(prev) {
+		prevFingerprint = prev.Fingerprint
+	}
+
+	archivePath, hash, fingerprint, report, err := create(prevFingerprint)
+	if err != nil {
+		return report, fmt.Errorf("creating archive: %w", err)
+	}
+	if archivePath == "" {
+		if r.dryRun {
+			log.Printf("[dry-run] would skip %s (fingerprint unchanged)", source)
+			return report, nil
 		}
-		os.Remove(archivePath)
+		log.Printf("skipping %s (fingerprint unchanged)", source)
+		r.state.Source(source).LastSuccess = time.Now().UTC()
+		r.saveState()
+		return report, nil
+	}
+	defer os.Remove(archivePath)
 
-		checksums[slug] = hash
-		if err := SaveChecksums(checksumsPath, checksums); err != nil {
-			log.Printf("warning: failed to save checksums: %v", err)
+	if prev != nil && prev.Hash == hash {
+		if !stale {
+			if r.dryRun {
+				log.Printf("[dry-run] would skip %s (unchanged)", source)
+				return report, nil
+			}
+			log.Printf("skipping %s (unchanged)", source)
+			now := time.Now().UTC()
+			ss := r.state.Source(source)
+			ss.Fingerprint = fingerprint
+			ss.CheckedAt = now
+			ss.LastSuccess = now
+			r.saveState()
+			return report, nil
+		}
+		if r.refreshSnapshot(ctx, source, key, prev) {
+			if !r.dryRun {
+				ss := r.state.Source(source)
+				ss.Fingerprint = fingerprint
+				ss.CheckedAt = ss.LastSuccess
+				r.saveState()
+			}
+			return report, nil
 		}
+		// The copy didn't work out, so upload the archive instead.
+	}
+
+	if r.dryRun {
+		log.Printf("[dry-run] would upload %s -> s3://%s/%s", source, r.cfg.Bucket, key)
+		return report, nil
+	}
+
+	log.Printf("backing up %s -> s3://%s/%s", source, r.cfg.Bucket, key)
+
+	if err := uploadArchive(ctx, r.cfg, key, source, archivePath, hash); err != nil {
+		return report, err
+	}
+
+	now := time.Now().UTC()
+	ss := r.state.Source(source)
+	ss.Hash = hash
+	ss.Key = key
+	ss.Size = 0
+	if info, err := os.Stat(archivePath); err == nil {
+		ss.Size = info.Size()
+	}
+	ss.UploadedAt = now
+	ss.Duration = now.Sub(start).Seconds()
+	ss.Fingerprint = fingerprint
+	ss.CheckedAt = now
+	ss.LastSuccess = now
+	r.saveState()
+
+	log.Printf("completed %s", source)
+	return report, nil
+}
+
+// snapshotStale reports whether the last upload of source, recorded in
+// prev, is older than its max_snapshot_age and should be refreshed even if
+// the source is unchanged.
+func (r *backupRun) snapshotStale(source string, prev *SourceState) bool {
+	maxAge := r.cfg.MaxSnapshotAge
+	if d, ok := r.cfg.FindDirectory(source); ok && d.MaxSnapshotAge != 0 {
+		maxAge = d.MaxSnapshotAge
+	}
+	return maxAge > 0 && prev != nil && prev.Hash != "" && time.Since(prev.UploadedAt) >= maxAge
+}
+
+// refreshSnapshot copies the last upload of an unchanged source, recorded
+// in prev, to key within the bucket, so recent history holds a complete
+// archive of it. It reports false if the caller should upload a fresh
+// archive instead: no key was recorded, or the copy failed.
+func (r *backupRun) refreshSnapshot(ctx context.Context, source, key string, prev *SourceState) bool {
+	if prev.Key == "" {
+		log.Printf("%s: latest snapshot is older than max_snapshot_age but its key isn't recorded; uploading a fresh archive", source)
+		return false
+	}
+	if r.dryRun {
+		log.Printf("[dry-run] would refresh %s (unchanged, latest snapshot is older than max_snapshot_age): s3://%s/%s -> s3://%s/%s", source, r.cfg.Bucket, prev.Key, r.cfg.Bucket, key)
+		return true
+	}
+
+	log.Printf("refreshing %s (unchanged, latest snapshot is older than max_snapshot_age): s3://%s/%s -> s3://%s/%s", source, r.cfg.Bucket, prev.Key, r.cfg.Bucket, key)
+	if err := CopyInS3(ctx, r.cfg.Region, r.cfg.Bucket, prev.Key, key); err != nil {
+		log.Printf("warning: %v; uploading a fresh archive instead", err)
+		return false
+	}
+
+	now := time.Now().UTC()
+	ss := r.state.Source(source)
+	ss.Key = key
+	ss.UploadedAt = now
+	ss.LastSuccess = now
+	r.saveState()
+	log.Printf("completed %s", source)
+	return true
+}
 
-		log.Printf("completed %s", d.Path)
+// deepCheckDue reports whether prev's source must be archived in full
+// whatever its fingerprint: with --deep-check, or when it hasn't been for
+// the config's deep_check_interval.
+func (r *backupRun) deepCheckDue(prev *SourceState) bool {
+	if r.deepCheck {
+		return true
 	}
+	interval := r.cfg.DeepCheckInterval
+	if interval == 0 {
+		interval = defaultDeepCheckInterval
+	}
+	return time.Since(prev.CheckedAt) >= interval
+}
+
+// recordFailure notes in the state file that backing up source failed.
+func (r *backupRun) recordFailure(source string, err error) {
+	if r.dryRun {
+		return
+	}
+	ss := r.state.Source(source)
+	ss.LastFailure = time.Now().UTC()
+	ss.LastError = err.Error()
+	r.saveState()
+}
 
-	if len(failed) > 0 {
-		log.Fatalf("failed to back up %d directories: %v", len(failed), failed)
+// saveState writes the state file. A failure is only logged: the backups
+// themselves are done, and the worst case is a redundant upload next run.
+func (r *backupRun) saveState() {
+	if err := r.state.Save(r.statePath); err != nil {
+		log.Printf("warning: failed to save state: %v", err)
 	}
 }
 
 // createArchiveWithHash takes online snapshots of any SQLite databases
 // declared in d, then creates a temp archive of d.Path with the snapshots
-// substituted for the live files. Returns the archive path and its
-// SHA-256 hex digest.
-func createArchiveWithHash(d Directory) (path string, hash string, err error) {
+// substituted for the live files. Returns the archive path, its SHA-256
+// hex digest, the tree's fingerprint (see TreeFingerprint) and the report
+// of any entries that had to be skipped.
+//
+// If prevFingerprint is set and the fingerprint matches it, nothing is
+// archived and the path and hash are empty.
+//
+// If d has a docker block, its containers are paused or stopped for the
+// snapshot and archive and resumed before this returns. Failing to resume
+// them fails the directory, so a container left down is never silent.
+func createArchiveWithHash(ctx context.Context, d Directory, prevFingerprint string) (path string, hash string, fingerprint string, report ArchiveReport, err error) {
 	info, err := os.Stat(d.Path)
 	if err != nil {
-		return "", "", fmt.Errorf("accessing directory: %w", err)
+		return "", "", "", report, fmt.Errorf("accessing directory: %w", err)
 	}
 	if !info.IsDir() {
-		return "", "", fmt.Errorf("%s is not a directory", d.Path)
+		return "", "", "", report, fmt.Errorf("%s is not a directory", d.Path)
+	}
+
+	if d.Docker != nil {
+		resume, err := QuiesceContainers(ctx, *d.Docker)
+		if err != nil {
+			return "", "", "", report, fmt.Errorf("quiescing containers: %w", err)
+		}
+		defer func() {
+			if rerr := resume(); rerr != nil {
+				if path != "" {
+					os.Remove(path)
+				}
+				path, hash = "", ""
+				err = errors.Join(err, fmt.Errorf("resuming containers: %w", rerr))
+			}
+		}()
 	}
 
 	snap, err := PrepareSnapshots(d)
 	if err != nil {
-		return "", "", fmt.Errorf("preparing snapshots: %w", err)
+		return "", "", "", report, fmt.Errorf("preparing snapshots: %w", err)
 	}
 	defer snap.Cleanup()
 
+	opts := d.ArchiveOptions()
+	fingerprint, err = TreeFingerprint(d.Path, snap.Overrides, snap.Excludes, opts)
+	if err != nil {
+		log.Printf("warning: can't fingerprint %s, archiving it in full: %v", d.Path, err)
+		fingerprint = ""
+	} else if prevFingerprint != "" && fingerprint == prevFingerprint {
+		return "", "", fingerprint, report, nil
+	}
+
+	path, hash, report, err = archiveToTemp(d.Path, snap.Overrides, snap.Excludes, opts)
+	return path, hash, fingerprint, report, err
+}
+
+// archiveToTemp runs CreateArchive into a temp file and returns the file's
+// path and SHA-256 hex digest along with the archive report.
+func archiveToTemp(dir string, overrides map[string]string, excludes map[string]bool, opts ArchiveOptions) (path string, hash string, report ArchiveReport, err error) {
 	tmpFile, err := os.CreateTemp("", "pi-backup-*.tar.gz")
 	if err != nil {
-		return "", "", fmt.Errorf("creating temp file: %w", err)
+		return "", "", report, fmt.Errorf("creating temp file: %w", err)
 	}
 	defer tmpFile.Close()
 
-	if err := CreateArchive(tmpFile, d.Path, snap.Overrides, snap.Excludes); err != nil {
+	report, err = CreateArchive(tmpFile, dir, overrides, excludes, opts)
+	if err != nil {
 		os.Remove(tmpFile.Name())
-		return "", "", fmt.Errorf("creating archive: %w", err)
+		return "", "", report, fmt.Errorf("creating archive: %w", err)
 	}
 
 	if _, err := tmpFile.Seek(0, 0); err != nil {
 		os.Remove(tmpFile.Name())
-		return "", "", fmt.Errorf("seeking temp file: %w", err)
+		return "", "", report, fmt.Errorf("seeking temp file: %w", err)
 	}
 
 	h := sha256.New()
 	if _, err := io.Copy(h, tmpFile); err != nil {
 		os.Remove(tmpFile.Name())
-		return "", "", fmt.Errorf("computing hash: %w", err)
+		return "", "", report, fmt.Errorf("computing hash: %w", err)
 	}
 
-	return tmpFile.Name(), fmt.Sprintf("%x", h.Sum(nil)), nil
+	return tmpFile.Name(), fmt.Sprintf("%x", h.Sum(nil)), report, nil
 }
 
-// uploadArchive uploads a temp archive file to S3.
-func uploadArchive(ctx context.Context, cfg *Config, key, archivePath string) error {
+// uploadArchive uploads a temp archive file to S3, recording its source
+// and hash in the object metadata.
+func uploadArchive(ctx context.Context, cfg *Config, key, source, archivePath, hash string) error {
 	f, err := os.Open(archivePath)
 	if err != nil {
 		return fmt.Errorf("opening archive: %w", err)
 	}
 	defer f.Close()
 
-	return UploadToS3(ctx, cfg.Region, cfg.Bucket, key, f)
+	return UploadToS3(ctx, cfg.Region, cfg.Bucket, key, f, map[string]string{
+		hashMetadataKey:   hash,
+		sourceMetadataKey: sourceMetadata(source),
+	})
 }
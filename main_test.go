@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestDryRun(t *testing.T) {
@@ -86,6 +90,48 @@ directories:
 	}
 }
 
+func TestPostHooksRunWhenDirectoryFails(t *testing.T) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "pi-backup")
+	build := exec.Command("go", "build", "-o", bin, ".")
+	if wd, err := os.Getwd(); err == nil {
+		build.Dir = wd
+	}
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("build failed: %v\n%s", err, out)
+	}
+
+	hookLog := filepath.Join(dir, "hooks.log")
+	configPath := filepath.Join(dir, "config.yaml")
+	os.WriteFile(configPath, []byte(fmt.Sprintf(`hostname: test
+bucket: test-bucket
+region: us-east-1
+hooks:
+  post_backup:
+    - command: echo "run $PI_BACKUP_STATUS" >> %[1]s
+directories:
+  - path: %[2]s
+    hooks:
+      pre_backup:
+        - command: echo "pre $PI_BACKUP_DIRECTORY" >> %[1]s
+      post_backup:
+        - command: echo "post $PI_BACKUP_STATUS" >> %[1]s
+`, hookLog, filepath.Join(dir, "missing"))), 0644)
+
+	cmd := exec.Command(bin, "--config", configPath)
+	cmd.Env = append(os.Environ(), "AWS_ACCESS_KEY_ID=fake", "AWS_SECRET_ACCESS_KEY=fake")
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("expected failure for missing directory\n%s", out)
+	}
+
+	got, _ := os.ReadFile(hookLog)
+	want := "pre " + filepath.Join(dir, "missing") + "\npost failure\nrun failure\n"
+	if string(got) != want {
+		t.Errorf("hook log = %q, want %q\noutput: %s", got, want, out)
+	}
+}
+
 func TestVersionFlag(t *testing.T) {
 	dir := t.TempDir()
 	bin := filepath.Join(dir, "pi-backup")
@@ -120,3 +166,98 @@ func containsStr(s, sub string) bool {
 	}
 	return false
 }
+
+// captureLog redirects the log package to a buffer for the rest of the test.
+func captureLog(t *testing.T) *strings.Builder {
+	t.Helper()
+	var buf strings.Builder
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestBackupSourceSkipsOnFingerprint(t *testing.T) {
+	logs := captureLog(t)
+	run := &backupRun{
+		cfg:    &Config{Bucket: "b"},
+		dryRun: true,
+		state: &State{Version: stateVersion, Sources: map[string]*SourceState{
+			"opt-x": {Hash: "h", Key: "cherry/opt-x/old.tar.gz", Fingerprint: "fp", CheckedAt: time.Now(), UploadedAt: time.Now()},
+		}},
+	}
+
+	var got string
+	_, err := run.backupSource(context.Background(), "/opt/x", "cherry/opt-x/new.tar.gz", func(prev string) (string, string, string, ArchiveReport, error) {
+		got = prev
+		return "", "", prev, ArchiveReport{}, nil
+	})
+	if err != nil {
+		t.Fatalf("backupSource: %v", err)
+	}
+	if got != "fp" {
+		t.Errorf("archive func got fingerprint %q, want fp", got)
+	}
+	if !strings.Contains(logs.String(), "would skip /opt/x (fingerprint unchanged)") {
+		t.Errorf("log = %q", logs.String())
+	}
+
+	// With --deep-check the fingerprint isn't offered.
+	run.deepCheck = true
+	run.backupSource(context.Background(), "/opt/x", "cherry/opt-x/new.tar.gz", func(prev string) (string, string, string, ArchiveReport, error) {
+		got = prev
+		return "", "", prev, ArchiveReport{}, nil
+	})
+	if got != "" {
+		t.Errorf("archive func got fingerprint %q with --deep-check", got)
+	}
+}
+
+func TestBackupSourceRefreshesStaleSnapshot(t *testing.T) {
+	logs := captureLog(t)
+	old := time.Now().Add(-48 * time.Hour)
+	run := &backupRun{
+		cfg: &Config{
+			Bucket:         "b",
+			MaxSnapshotAge: 24 * time.Hour,
+			Directories:    []Directory{{Path: "/opt/fresh", MaxSnapshotAge: 72 * time.Hour}},
+		},
+		dryRun: true,
+		state: &State{Version: stateVersion, Sources: map[string]*SourceState{
+			"opt-x":     {Hash: "h", Key: "cherry/opt-x/old.tar.gz", Fingerprint: "fp", CheckedAt: time.Now(), UploadedAt: old},
+			"opt-fresh": {Hash: "h", Key: "cherry/opt-fresh/old.tar.gz", Fingerprint: "fp", CheckedAt: time.Now(), UploadedAt: old},
+		}},
+	}
+	var offered []string
+	unchanged := func(prev string) (string, string, string, ArchiveReport, error) {
+		offered = append(offered, prev)
+		if prev != "" {
+			return "", "", prev, ArchiveReport{}, nil
+		}
+		f, err := os.CreateTemp(t.TempDir(), "archive-*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		return f.Name(), "h", "fp", ArchiveReport{}, nil
+	}
+
+	if _, err := run.backupSource(context.Background(), "/opt/x", "cherry/opt-x/new.tar.gz", unchanged); err != nil {
+		t.Fatalf("backupSource: %v", err)
+	}
+	// A stale source is archived once, in full, so a failed copy can fall
+	// back to uploading that archive.
+	if len(offered) != 1 || offered[0] != "" {
+		t.Errorf("archive func offered fingerprints %q, want one full archive", offered)
+	}
+	if !strings.Contains(logs.String(), "would refresh /opt/x") || !strings.Contains(logs.String(), "s3://b/cherry/opt-x/old.tar.gz -> s3://b/cherry/opt-x/new.tar.gz") {
+		t.Errorf("stale snapshot not refreshed; log = %q", logs.String())
+	}
+
+	// The directory's own max_snapshot_age wins over the config's.
+	if _, err := run.backupSource(context.Background(), "/opt/fresh", "cherry/opt-fresh/new.tar.gz", unchanged); err != nil {
+		t.Fatalf("backupSource: %v", err)
+	}
+	if !strings.Contains(logs.String(), "would skip /opt/fresh (fingerprint unchanged)") {
+		t.Errorf("/opt/fresh refreshed despite its longer max_snapshot_age; log = %q", logs.String())
+	}
+}
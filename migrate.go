@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// keyMove is one object migrate-host copies to another host's prefix.
+type keyMove struct {
+	From, To string
+}
+
+// planMigration returns the copies that move every key under oldHost/ to
+// the same place under newHost/, leaving out keys that already exist
+// there, which are returned separately.
+func planMigration(oldHost, newHost string, oldKeys, newKeys []string) (moves []keyMove, existing []string) {
+	have := map[string]bool{}
+	for _, k := range newKeys {
+		have[k] = true
+	}
+	for _, k := range oldKeys {
+		rest, ok := strings.CutPrefix(k, oldHost+"/")
+		if !ok {
+			continue
+		}
+		to := newHost + "/" + rest
+		if have[to] {
+			existing = append(existing, to)
+			continue
+		}
+		moves = append(moves, keyMove{From: k, To: to})
+	}
+	return moves, existing
+}
+
+// runMigrateHost handles the "migrate-host" subcommand, which copies a
+// host's backups to another host's prefix, server side, so a replacement
+// device carries on the old one's history.
+func runMigrateHost(cfg *Config, configPath string, args []string) {
+	fs := flag.NewFlagSet("migrate-host", flag.ExitOnError)
+	move := fs.Bool("move", false, "delete each of the old host's backups once it has been copied")
+	dryRun := fs.Bool("dry-run", false, "log what would be copied without copying")
+	lockOpts := addLockFlags(fs)
+	positional := parseInterspersed(fs, args)
+	if len(positional) != 2 || positional[0] == positional[1] {
+		fmt.Fprintf(os.Stderr, "Usage: pi-backup migrate-host <old-host> <new-host> [--move] [--dry-run] [--wait]\n")
+		os.Exit(1)
+	}
+	oldHost, newHost := positional[0], positional[1]
+
+	lock, err := AcquireLock(LockPath(configPath), "migrate-host", *lockOpts)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	defer lock.Release()
+
+	ctx := context.Background()
+	oldKeys, err := ListHostBackups(ctx, cfg, oldHost, "")
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	if len(oldKeys) == 0 {
+		log.Fatalf("error: no backups found for host %s", oldHost)
+	}
+	newKeys, err := ListHostBackups(ctx, cfg, newHost, "")
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+
+	moves, existing := planMigration(oldHost, newHost, oldKeys, newKeys)
+	for _, k := range existing {
+		log.Printf("s3://%s/%s already exists; leaving it", cfg.Bucket, k)
+	}
+
+	var copied []string
+	var failed int
+	for _, m := range moves {
+		if *dryRun {
+			log.Printf("[dry-run] would copy s3://%s/%s -> %s", cfg.Bucket, m.From, m.To)
+			continue
+		}
+		if err := CopyInS3(ctx, cfg.Region, cfg.Bucket, m.From, m.To); err != nil {
+			log.Printf("error: %v", err)
+			failed++
+			continue
+		}
+		log.Printf("copied s3://%s/%s -> %s", cfg.Bucket, m.From, m.To)
+		copied = append(copied, m.From)
+	}
+
+	if *move && !*dryRun {
+		// Keys that already existed under the new host were never copied
+		// and stay put, like any that failed to copy.
+		deleted, err := DeleteFromS3(ctx, cfg.Region, cfg.Bucket, copied)
+		for _, k := range deleted {
+			log.Printf("deleted s3://%s/%s", cfg.Bucket, k)
+		}
+		if err != nil {
+			log.Fatalf("error deleting %s's backups: %v", oldHost, err)
+		}
+	}
+
+	if failed > 0 {
+		log.Fatalf("error: %d of %d backups couldn't be copied", failed, len(moves))
+	}
+	if *dryRun {
+		return
+	}
+	log.Printf("migrated %d backups from %s to %s", len(copied), oldHost, newHost)
+	if newHost == cfg.Hostname {
+		log.Printf("run `pi-backup state rebuild` so the next backup skips unchanged directories")
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanMigration(t *testing.T) {
+	oldKeys := []string{
+		"cherry/opt-data/2026-02-10T03-00-00Z.tar.gz",
+		"cherry/opt-data/2026-02-11T03-00-00Z.tar.gz",
+		"cherry-two/opt-data/2026-02-11T03-00-00Z.tar.gz", // another host sharing the prefix text
+	}
+	newKeys := []string{
+		"plum/opt-data/2026-02-11T03-00-00Z.tar.gz",
+	}
+
+	moves, existing := planMigration("cherry", "plum", oldKeys, newKeys)
+	wantMoves := []keyMove{{
+		From: "cherry/opt-data/2026-02-10T03-00-00Z.tar.gz",
+		To:   "plum/opt-data/2026-02-10T03-00-00Z.tar.gz",
+	}}
+	if !reflect.DeepEqual(moves, wantMoves) {
+		t.Errorf("moves = %v, want %v", moves, wantMoves)
+	}
+	if want := []string{"plum/opt-data/2026-02-11T03-00-00Z.tar.gz"}; !reflect.DeepEqual(existing, want) {
+		t.Errorf("existing = %v, want %v", existing, want)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// deleteBatchSize is the most keys S3 accepts in one DeleteObjects call.
+const deleteBatchSize = 1000
+
+// Retention is a grandfather-father-son policy: keep the newest KeepLast
+// snapshots, plus the newest snapshot of each of the last KeepDaily days,
+// KeepWeekly ISO weeks, KeepMonthly months and KeepYearly years that have
+// one. A snapshot kept by any rule is kept. Periods are in UTC, like the
+// timestamps in the keys.
+type Retention struct {
+	KeepLast    int `yaml:"keep_last,omitempty"`
+	KeepDaily   int `yaml:"keep_daily,omitempty"`
+	KeepWeekly  int `yaml:"keep_weekly,omitempty"`
+	KeepMonthly int `yaml:"keep_monthly,omitempty"`
+	KeepYearly  int `yaml:"keep_yearly,omitempty"`
+}
+
+// validate checks r. field names the retention block in errors.
+func (r Retention) validate(field string) error {
+	for name, n := range map[string]int{
+		"keep_last":    r.KeepLast,
+		"keep_daily":   r.KeepDaily,
+		"keep_weekly":  r.KeepWeekly,
+		"keep_monthly": r.KeepMonthly,
+		"keep_yearly":  r.KeepYearly,
+	} {
+		if n < 0 {
+			return fmt.Errorf("config: %s.%s must not be negative", field, name)
+		}
+	}
+	if r == (Retention{}) {
+		return fmt.Errorf("config: %s: at least one keep_* rule is required", field)
+	}
+	return nil
+}
+
+// Snapshot is one archive in the bucket and the time in its key.
+type Snapshot struct {
+	Key  string
+	Time time.Time
+}
+
+// ParseSnapshotTime returns the timestamp S3Key encoded in key.
+func ParseSnapshotTime(key string) (time.Time, error) {
+	ts, ok := strings.CutSuffix(path.Base(key), ".tar.gz")
+	if !ok {
+		return time.Time{}, fmt.Errorf("%s: not a backup archive", key)
+	}
+	t, err := time.Parse(snapshotTimeFormat, ts)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s: bad timestamp: %w", key, err)
+	}
+	return t, nil
+}
+
+// Keep returns the keys of snaps that r keeps. The newest snapshot is
+// always kept, whatever the policy.
+func (r Retention) Keep(snaps []Snapshot) map[string]bool {
+	snaps = append([]Snapshot(nil), snaps...)
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].Time.After(snaps[j].Time) })
+
+	keep := map[string]bool{}
+	if len(snaps) == 0 {
+		return keep
+	}
+	keep[snaps[0].Key] = true
+
+	for i := 0; i < r.KeepLast && i < len(snaps); i++ {
+		keep[snaps[i].Key] = true
+	}
+
+	rules := []struct {
+		n      int
+		period func(time.Time) string
+	}{
+		{r.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{r.KeepWeekly, func(t time.Time) string {
+			y, w := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", y, w)
+		}},
+		{r.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{r.KeepYearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+	for _, rule := range rules {
+		// Newest first, so the first snapshot seen in a period is that
+		// period's newest.
+		last, kept := "", 0
+		for _, s := range snaps {
+			if kept >= rule.n {
+				break
+			}
+			p := rule.period(s.Time.UTC())
+			if p == last {
+				continue
+			}
+			last = p
+			keep[s.Key] = true
+			kept++
+		}
+	}
+	return keep
+}
+
+// planPrune splits keys into the ones r keeps and the ones to delete.
+// Keys whose timestamp can't be parsed are never deleted; they're returned
+// in skipped along with the reason.
+func planPrune(keys []string, r Retention) (keep, remove []string, skipped []error) {
+	var snaps []Snapshot
+	for _, k := range keys {
+		t, err := ParseSnapshotTime(k)
+		if err != nil {
+			skipped = append(skipped, err)
+			continue
+		}
+		snaps = append(snaps, Snapshot{Key: k, Time: t})
+	}
+	kept := r.Keep(snaps)
+	for _, s := range snaps {
+		if kept[s.Key] {
+			keep = append(keep, s.Key)
+		} else {
+			remove = append(remove, s.Key)
+		}
+	}
+	sort.Strings(keep)
+	sort.Strings(remove)
+	return keep, remove, skipped
+}
+
+// DeleteFromS3 deletes keys from bucket in batches. It returns the keys
+// that were deleted, which on error may be only some of them.
+func DeleteFromS3(ctx context.Context, region, bucket string, keys []string) ([]string, error) {
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("loading AWS config: %w", err)
+	}
+
+	client := s3.NewFromConfig(awsCfg)
+	var deleted []string
+	for start := 0; start < len(keys); start += deleteBatchSize {
+		batch := keys[start:min(start+deleteBatchSize, len(keys))]
+		objects := make([]types.ObjectIdentifier, len(batch))
+		for i, k := range batch {
+			objects[i] = types.ObjectIdentifier{Key: aws.String(k)}
+		}
+		out, err := client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return deleted, fmt.Errorf("deleting from s3://%s: %w", bucket, err)
+		}
+		// In quiet mode S3 only reports the keys it failed to delete.
+		failed := map[string]bool{}
+		for _, e := range out.Errors {
+			failed[aws.ToString(e.Key)] = true
+		}
+		for _, k := range batch {
+			if !failed[k] {
+				deleted = append(deleted, k)
+			}
+		}
+		if len(out.Errors) > 0 {
+			e := out.Errors[0]
+			return deleted, fmt.Errorf("deleting s3://%s/%s: %s (%d keys failed)", bucket, aws.ToString(e.Key), aws.ToString(e.Message), len(out.Errors))
+		}
+	}
+	return deleted, nil
+}
+
+// runPrune handles the "prune" subcommand.
+func runPrune(cfg *Config, configPath string, args []string) {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "log what would be deleted without deleting")
+	lockOpts := addLockFlags(fs)
+	fs.Parse(args)
+
+	lock, err := AcquireLock(LockPath(configPath), "prune", *lockOpts)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	defer lock.Release()
+
+	ctx := context.Background()
+	var failed []string
+	for _, src := range cfg.retentionSources() {
+		if err := pruneSource(ctx, cfg, src.id, src.retention, *dryRun); err != nil {
+			log.Printf("error pruning %s: %v", src.id, err)
+			failed = append(failed, src.id)
+		}
+	}
+	if len(failed) > 0 {
+		log.Fatalf("failed to prune %d sources: %v", len(failed), failed)
+	}
+}
+
+// retentionSource is a backup source and the retention policy that applies
+// to it.
+type retentionSource struct {
+	id        string
+	retention Retention
+}
+
+// retentionSources returns every configured source that has a retention
+// policy: the directory's own, else the config-wide one.
+func (c *Config) retentionSources() []retentionSource {
+	var out []retentionSource
+	for _, d := range c.Directories {
+		switch {
+		case d.Retention != nil:
+			out = append(out, retentionSource{d.Path, *d.Retention})
+		case c.Retention != nil:
+			out = append(out, retentionSource{d.Path, *c.Retention})
+		}
+	}
+	if c.Retention != nil {
+		for _, cs := range c.Commands {
+			out = append(out, retentionSource{cs.ID(), *c.Retention})
+		}
+	}
+	return out
+}
+
+// pruneSource deletes the snapshots of source that r doesn't keep.
+func pruneSource(ctx context.Context, cfg *Config, source string, r Retention, dryRun bool) error {
+	keys, err := ListBackups(ctx, cfg, source)
+	if err != nil {
+		return err
+	}
+	keep, remove, skipped := planPrune(keys, r)
+	for _, err := range skipped {
+		log.Printf("warning: not pruning %v", err)
+	}
+	if len(remove) == 0 {
+		log.Printf("%s: keeping all %d snapshots", source, len(keep))
+		return nil
+	}
+
+	if dryRun {
+		for _, k := range remove {
+			log.Printf("[dry-run] would delete s3://%s/%s", cfg.Bucket, k)
+		}
+		log.Printf("[dry-run] %s: would keep %d snapshots, remove %d", source, len(keep), len(remove))
+		return nil
+	}
+
+	deleted, err := DeleteFromS3(ctx, cfg.Region, cfg.Bucket, remove)
+	for _, k := range deleted {
+		log.Printf("deleted s3://%s/%s", cfg.Bucket, k)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("%s: kept %d snapshots, removed %d", source, len(keep), len(deleted))
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSnapshotTime(t *testing.T) {
+	want := time.Date(2026, 2, 11, 3, 0, 0, 0, time.UTC)
+	got, err := ParseSnapshotTime(S3Key("cherry", "/opt/x", want))
+	if err != nil {
+		t.Fatalf("ParseSnapshotTime: %v", err)
+	}
+	if !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, key := range []string{"cherry/opt-x/notes.txt", "cherry/opt-x/yesterday.tar.gz"} {
+		if _, err := ParseSnapshotTime(key); err == nil {
+			t.Errorf("ParseSnapshotTime(%q): expected error", key)
+		}
+	}
+}
+
+// dailyKeys returns keys for one snapshot a day at 03:00 UTC for n days
+// ending on end, oldest first.
+func dailyKeys(end time.Time, n int) []string {
+	var keys []string
+	for i := n - 1; i >= 0; i-- {
+		keys = append(keys, S3Key("cherry", "/opt/x", end.AddDate(0, 0, -i)))
+	}
+	return keys
+}
+
+func TestPlanPruneKeepLast(t *testing.T) {
+	end := time.Date(2026, 3, 31, 3, 0, 0, 0, time.UTC)
+	keys := dailyKeys(end, 10)
+
+	keep, remove, skipped := planPrune(keys, Retention{KeepLast: 3})
+	if len(skipped) != 0 {
+		t.Fatalf("skipped = %v", skipped)
+	}
+	if !equalSlice(keep, keys[7:]) {
+		t.Errorf("keep = %v, want %v", keep, keys[7:])
+	}
+	if !equalSlice(remove, keys[:7]) {
+		t.Errorf("remove = %v, want %v", remove, keys[:7])
+	}
+}
+
+func TestPlanPruneGFS(t *testing.T) {
+	// A year of daily snapshots ending on Tuesday 2026-03-31, plus a second
+	// snapshot later on the last day.
+	end := time.Date(2026, 3, 31, 3, 0, 0, 0, time.UTC)
+	keys := dailyKeys(end, 365)
+	latest := S3Key("cherry", "/opt/x", end.Add(12*time.Hour))
+	keys = append(keys, latest)
+
+	keep, _, _ := planPrune(keys, Retention{KeepDaily: 7, KeepWeekly: 4, KeepMonthly: 6, KeepYearly: 2})
+	kept := map[string]bool{}
+	for _, k := range keep {
+		kept[k] = true
+	}
+
+	key := func(y int, m time.Month, d int) string {
+		return S3Key("cherry", "/opt/x", time.Date(y, m, d, 3, 0, 0, 0, time.UTC))
+	}
+	for _, want := range []string{
+		latest,            // newest of 2026-03-31, kept by every rule
+		key(2026, 3, 25),  // 7th day
+		key(2026, 3, 22),  // Sunday ending ISO week 12
+		key(2026, 3, 15),  // 4th week
+		key(2026, 2, 28),  // end of February
+		key(2025, 10, 31), // 6th month
+		key(2025, 12, 31), // end of 2025
+	} {
+		if !kept[want] {
+			t.Errorf("%s not kept", want)
+		}
+	}
+	for _, notWant := range []string{
+		key(2026, 3, 31), // superseded by the later snapshot that day
+		key(2026, 3, 24),
+		key(2026, 3, 8),
+		key(2026, 3, 1),
+		key(2025, 9, 30),
+	} {
+		if kept[notWant] {
+			t.Errorf("%s kept", notWant)
+		}
+	}
+	// 7 daily, 2 more weekly, 5 more monthly; the yearly pick for 2025
+	// is 2025-12-31, already kept as a monthly.
+	if len(keep) != 7+2+5 {
+		t.Errorf("kept %d snapshots: %v", len(keep), keep)
+	}
+}
+
+func TestPlanPruneAlwaysKeepsNewest(t *testing.T) {
+	keys := dailyKeys(time.Date(2026, 3, 31, 3, 0, 0, 0, time.UTC), 3)
+	keep, remove, _ := planPrune(keys, Retention{})
+	if !equalSlice(keep, keys[2:]) || !equalSlice(remove, keys[:2]) {
+		t.Errorf("keep = %v, remove = %v", keep, remove)
+	}
+}
+
+func TestPlanPruneLeavesUnparsableKeys(t *testing.T) {
+	keys := append(dailyKeys(time.Date(2026, 3, 31, 3, 0, 0, 0, time.UTC), 3), "cherry/opt-x/manual-copy.tar.gz")
+	keep, remove, skipped := planPrune(keys, Retention{KeepLast: 1})
+	if len(skipped) != 1 {
+		t.Errorf("skipped = %v, want the manual copy", skipped)
+	}
+	if len(keep) != 1 || len(remove) != 2 {
+		t.Errorf("keep = %v, remove = %v", keep, remove)
+	}
+	for _, k := range remove {
+		if k == "cherry/opt-x/manual-copy.tar.gz" {
+			t.Error("unparsable key planned for deletion")
+		}
+	}
+}
+
+func TestRetentionSources(t *testing.T) {
+	cfg := &Config{
+		Retention: &Retention{KeepDaily: 7},
+		Directories: []Directory{
+			{Path: "/a"},
+			{Path: "/b", Retention: &Retention{KeepLast: 2}},
+		},
+		Commands: []CommandSource{{Name: "sys"}},
+	}
+	got := cfg.retentionSources()
+	want := []retentionSource{
+		{"/a", Retention{KeepDaily: 7}},
+		{"/b", Retention{KeepLast: 2}},
+		{"cmd:sys", Retention{KeepDaily: 7}},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("source %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	cfg.Retention = nil
+	if got := cfg.retentionSources(); len(got) != 1 || got[0].id != "/b" {
+		t.Errorf("without a config-wide policy got %v, want only /b", got)
+	}
+}
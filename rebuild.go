@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ObjectInfo is what HeadObject tells us about an uploaded archive.
+type ObjectInfo struct {
+	Size     int64
+	Modified time.Time
+	Hash     string // from the object metadata; empty for older uploads
+	Source   string // likewise
+}
+
+// errObjectNotFound is returned by StatObject for a key that doesn't exist.
+var errObjectNotFound = errors.New("object not found")
+
+// StatObject returns the size, modification time and recorded hash of the
+// object at key, or errObjectNotFound.
+func StatObject(ctx context.Context, region, bucket, key string) (ObjectInfo, error) {
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(region))
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("loading AWS config: %w", err)
+	}
+
+	client := s3.NewFromConfig(awsCfg)
+	out, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var nf *types.NotFound
+		if errors.As(err, &nf) {
+			return ObjectInfo{}, fmt.Errorf("s3://%s/%s: %w", bucket, key, errObjectNotFound)
+		}
+		return ObjectInfo{}, fmt.Errorf("checking s3://%s/%s: %w", bucket, key, err)
+	}
+	source, _ := url.PathUnescape(out.Metadata[sourceMetadataKey])
+	return ObjectInfo{
+		Size:     aws.ToInt64(out.ContentLength),
+		Modified: aws.ToTime(out.LastModified),
+		Hash:     out.Metadata[hashMetadataKey],
+		Source:   source,
+	}, nil
+}
+
+// newestSnapshot returns the most recent key among keys that carries a
+// pi-backup timestamp.
+func newestSnapshot(keys []string) (string, bool) {
+	var newest string
+	var newestTime time.Time
+	for _, k := range keys {
+		t, err := ParseSnapshotTime(k)
+		if err != nil {
+			continue
+		}
+		if newest == "" || t.After(newestTime) {
+			newest, newestTime = k, t
+		}
+	}
+	return newest, newest != ""
+}
+
+// RebuildState replaces the upload records in s with the newest archive of
+// each configured source in the bucket. The hash comes from the object's
+// metadata or, for archives uploaded before it was recorded there, from
+// downloading and hashing the archive. Sources with nothing in the bucket
+// lose their record, so the next run uploads them. Success and failure
+// history is kept.
+func RebuildState(ctx context.Context, cfg *Config, s *State) error {
+	for _, id := range cfg.SourceIDs() {
+		keys, err := ListBackups(ctx, cfg, id)
+		if err != nil {
+			return err
+		}
+		key, ok := newestSnapshot(keys)
+		if !ok {
+			if ss := s.Sources[PathSlug(id)]; ss != nil && ss.Hash != "" {
+				log.Printf("%s: no backups in the bucket; forgetting its recorded upload", id)
+				clearUpload(ss)
+			}
+			continue
+		}
+
+		info, err := StatObject(ctx, cfg.Region, cfg.Bucket, key)
+		if err != nil {
+			return err
+		}
+		hash := info.Hash
+		if hash == "" {
+			log.Printf("%s: no hash recorded for %s; downloading it to hash", id, key)
+			if hash, err = hashObject(ctx, cfg, key); err != nil {
+				return err
+			}
+		}
+
+		ss := s.Source(id)
+		ss.Hash = hash
+		ss.Key = key
+		ss.Size = info.Size
+		ss.UploadedAt = info.Modified.UTC()
+		ss.Duration = 0
+		ss.Fingerprint = "" // describes whatever was last archived here, not this object
+		log.Printf("%s: %s (sha256 %s)", id, key, hash)
+	}
+	return nil
+}
+
+// clearUpload forgets the last upload recorded in ss.
+func clearUpload(ss *SourceState) {
+	ss.Hash = ""
+	ss.Key = ""
+	ss.Size = 0
+	ss.UploadedAt = time.Time{}
+	ss.Duration = 0
+	ss.Fingerprint = ""
+}
+
+// hashObject downloads the object at key and returns its SHA-256 hex digest.
+func hashObject(ctx context.Context, cfg *Config, key string) (string, error) {
+	h := sha256.New()
+	if err := DownloadFromS3(ctx, cfg.Region, cfg.Bucket, key, h); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// verifyState drops the recorded hash of every source in s whose recorded
+// upload no longer exists, so it's uploaded again rather than skipped as
+// unchanged. Records with no key (migrated from checksums.json) can't be
+// checked and are dropped too. exists reports whether a key exists; if it
+// fails for another reason the record is kept and a warning logged.
+func verifyState(s *State, exists func(key string) (bool, error)) {
+	for slug, ss := range s.Sources {
+		if ss.Hash == "" {
+			continue
+		}
+		name := ss.Source
+		if name == "" {
+			name = slug
+		}
+		if ss.Key == "" {
+			log.Printf("%s: no upload recorded to verify; it will be uploaded again", name)
+			clearUpload(ss)
+			continue
+		}
+		ok, err := exists(ss.Key)
+		if err != nil {
+			log.Printf("warning: %s: couldn't verify %s: %v", name, ss.Key, err)
+			continue
+		}
+		if !ok {
+			log.Printf("%s: recorded upload %s is missing from the bucket; it will be uploaded again", name, ss.Key)
+			clearUpload(ss)
+		}
+	}
+}
+
+// VerifyState checks every upload recorded in s against the bucket; see
+// verifyState.
+func VerifyState(ctx context.Context, cfg *Config, s *State) {
+	verifyState(s, func(key string) (bool, error) {
+		_, err := StatObject(ctx, cfg.Region, cfg.Bucket, key)
+		if errors.Is(err, errObjectNotFound) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+}
+
+// runState handles the "state" subcommand.
+func runState(cfg *Config, configPath string, args []string) {
+	if len(args) == 0 || args[0] != "rebuild" {
+		fmt.Fprintf(os.Stderr, "Usage: pi-backup state rebuild [--dry-run] [--wait]\n")
+		os.Exit(1)
+	}
+
+	fs := flag.NewFlagSet("state rebuild", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "log the rebuilt state without saving it")
+	lockOpts := addLockFlags(fs)
+	fs.Parse(args[1:])
+
+	lock, err := AcquireLock(LockPath(configPath), "state rebuild", *lockOpts)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	defer lock.Release()
+
+	statePath := StatePath(configPath)
+	state, err := LoadState(statePath)
+	if err != nil {
+		log.Fatalf("error loading state: %v", err)
+	}
+	if err := RebuildState(context.Background(), cfg, state); err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	if *dryRun {
+		log.Printf("[dry-run] not saving %s", statePath)
+		return
+	}
+	if err := state.Save(statePath); err != nil {
+		log.Fatalf("error saving state: %v", err)
+	}
+	log.Printf("rebuilt %s", statePath)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNewestSnapshot(t *testing.T) {
+	t1 := time.Date(2026, 2, 10, 3, 0, 0, 0, time.UTC)
+	t2 := t1.Add(24 * time.Hour)
+	keys := []string{
+		S3Key("cherry", "/opt/x", t2),
+		"cherry/opt-x/zz-manual.tar.gz",
+		S3Key("cherry", "/opt/x", t1),
+	}
+	got, ok := newestSnapshot(keys)
+	if !ok || got != S3Key("cherry", "/opt/x", t2) {
+		t.Errorf("newestSnapshot = %q, %v", got, ok)
+	}
+
+	if _, ok := newestSnapshot([]string{"cherry/opt-x/zz-manual.tar.gz"}); ok {
+		t.Error("newestSnapshot found a snapshot among unparsable keys")
+	}
+}
+
+func TestVerifyState(t *testing.T) {
+	s := &State{Version: stateVersion, Sources: map[string]*SourceState{
+		"present":  {Source: "/present", Hash: "a", Key: "cherry/present/1.tar.gz", Size: 10},
+		"missing":  {Source: "/missing", Hash: "b", Key: "cherry/missing/1.tar.gz", Size: 10},
+		"flaky":    {Source: "/flaky", Hash: "c", Key: "cherry/flaky/1.tar.gz"},
+		"migrated": {Hash: "d"},
+	}}
+	verifyState(s, func(key string) (bool, error) {
+		switch key {
+		case "cherry/present/1.tar.gz":
+			return true, nil
+		case "cherry/flaky/1.tar.gz":
+			return false, errors.New("timeout")
+		}
+		return false, nil
+	})
+
+	if got := s.Sources["present"]; got.Hash != "a" || got.Key == "" {
+		t.Errorf("present record changed: %+v", got)
+	}
+	if got := s.Sources["missing"]; got.Hash != "" || got.Key != "" || got.Size != 0 {
+		t.Errorf("missing record kept: %+v", got)
+	}
+	if got := s.Sources["flaky"]; got.Hash != "c" {
+		t.Errorf("record dropped on a verify error: %+v", got)
+	}
+	if got := s.Sources["migrated"]; got.Hash != "" {
+		t.Errorf("unverifiable record kept: %+v", got)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// recoveryItem is one directory a restore --all will restore.
+type recoveryItem struct {
+	Path string // the directory's original path
+	Key  string
+	Dest string // where the archive is extracted: the parent of Path, under the root
+}
+
+// planRecovery works out what restore --all restores from the keys of one
+// host's backups. Without configured, that is every directory found in the
+// keys; command sources are left out. A directory's original path comes
+// from the config when it's configured there, and otherwise from
+// sourceOf, which returns the source recorded with an archive. With
+// configured, it is every directory in the config instead.
+//
+// snapshot and at select each directory's snapshot as for
+// ResolveSnapshot, and archives are extracted to their original location
+// under root. Directories that can't be restored are returned as errors.
+func planRecovery(cfg *Config, host string, keys []string, configured bool, snapshot, at, root string, sourceOf func(key string) (string, error)) ([]recoveryItem, []error) {
+	bySlug := map[string][]string{}
+	for _, k := range keys {
+		slug, _, ok := strings.Cut(strings.TrimPrefix(k, host+"/"), "/")
+		if ok {
+			bySlug[slug] = append(bySlug[slug], k)
+		}
+	}
+	paths := map[string]string{} // slug -> configured path
+	for _, d := range cfg.Directories {
+		paths[PathSlug(d.Path)] = d.Path
+	}
+	commands := map[string]string{} // slug -> configured command source
+	for _, c := range cfg.Commands {
+		commands[PathSlug(c.ID())] = c.ID()
+	}
+
+	var slugs []string
+	if configured {
+		for _, d := range cfg.Directories {
+			slugs = append(slugs, PathSlug(d.Path))
+		}
+	} else {
+		for slug := range bySlug {
+			if id, ok := commands[slug]; ok {
+				log.Printf("skipping command source %s", id)
+				continue
+			}
+			slugs = append(slugs, slug)
+		}
+		sort.Strings(slugs)
+	}
+
+	var items []recoveryItem
+	var errs []error
+	for _, slug := range slugs {
+		name := slug
+		if p, ok := paths[slug]; ok {
+			name = p
+		}
+		key, err := ResolveSnapshot(bySlug[slug], snapshot, at)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+
+		path, ok := paths[slug]
+		if !ok {
+			source, err := sourceOf(key)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", slug, err))
+				continue
+			}
+			// Slugs can't tell a command source from a directory whose
+			// name starts with "cmd-", but the recorded source can.
+			if strings.HasPrefix(source, commandPrefix) {
+				log.Printf("skipping command source %s", source)
+				continue
+			}
+			if !filepath.IsAbs(source) || PathSlug(source) != slug {
+				errs = append(errs, fmt.Errorf("%s: not in the config and no source path recorded in its archive; restore it by hand with --dest", slug))
+				continue
+			}
+			path = source
+		}
+		items = append(items, recoveryItem{
+			Path: path,
+			Key:  key,
+			Dest: filepath.Join(root, filepath.Dir(path)),
+		})
+	}
+	return items, errs
+}
+
+// confirm asks question on stdout and reports whether the answer read from
+// r is yes.
+func confirm(r io.Reader, question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(r).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// runRestoreAll handles "restore --all", restoring every directory of a
+// host at once.
+func runRestoreAll(cfg *Config, configPath string, args []string) {
+	fs := flag.NewFlagSet("restore --all", flag.ExitOnError)
+	host := addFromHostFlag(fs, cfg)
+	fs.StringVar(host, "host", cfg.Hostname, "same as --from-host")
+	configured := fs.Bool("configured", false, "restore the directories in the config rather than every directory in the bucket")
+	snapshot := fs.String("snapshot", "", "restore this snapshot of each directory (see restore --snapshot)")
+	at := fs.String("at", "", "restore each directory's newest snapshot taken at or before this local time")
+	root := fs.String("root", "", "restore under this directory instead of to the original paths")
+	yes := fs.Bool("yes", false, "don't ask for confirmation")
+	lockOpts := addLockFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Usage: pi-backup restore --all [--from-host <name>] [--configured] [--snapshot <TS>|--at <time>] [--root <dir>] [--yes]\n")
+		os.Exit(1)
+	}
+	if *snapshot != "" && *at != "" {
+		log.Fatal("error: --snapshot and --at can't be combined")
+	}
+
+	ctx := context.Background()
+	keys, err := ListHostBackups(ctx, cfg, *host, "")
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	if len(keys) == 0 && !*configured {
+		log.Fatalf("error: no backups found for host %s", *host)
+	}
+	items, planErrs := planRecovery(cfg, *host, keys, *configured, *snapshot, *at, *root, func(key string) (string, error) {
+		info, err := StatObject(ctx, cfg.Region, cfg.Bucket, key)
+		return info.Source, err
+	})
+
+	fmt.Printf("Restoring from s3://%s/%s/:\n", cfg.Bucket, *host)
+	for _, it := range items {
+		fmt.Printf("  %s  <-  %s\n", filepath.Join(*root, it.Path), snapshotName(it.Key))
+	}
+	for _, err := range planErrs {
+		fmt.Printf("  skipping %v\n", err)
+	}
+	if len(items) == 0 {
+		log.Fatal("error: nothing to restore")
+	}
+	if !*yes && !confirm(os.Stdin, fmt.Sprintf("Restore %d directories?", len(items))) {
+		log.Fatal("aborted")
+	}
+
+	// Only lock once confirmed, so scheduled backups aren't held up
+	// while the prompt waits.
+	lock, err := AcquireLock(LockPath(configPath), "restore", *lockOpts)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	defer lock.Release()
+
+	// Run-wide hooks wrap the whole recovery, and each directory's hooks
+	// wrap its restore, mirroring backups.
+	runEnv := HookEnv{Phase: "pre_restore", Hostname: cfg.Hostname, Bucket: cfg.Bucket}
+	results := map[string]error{}
+	var failed int
+	runErr := RunHooks(ctx, cfg.Hooks.PreRestore, runEnv)
+	if runErr != nil {
+		log.Printf("error: %v; not restoring any directories", runErr)
+	} else {
+		for _, it := range items {
+			d, _ := cfg.FindDirectory(it.Path)
+			env := runEnv
+			env.Directory = it.Path
+			env.Key = it.Key
+			env.Dest = it.Dest
+
+			err := RunHooks(ctx, d.Hooks.PreRestore, env)
+			if err == nil {
+				err = RestoreBackup(ctx, cfg, it.Key, it.Dest, restoredName(it.Path), cfg.ExtractOptions())
+			}
+			if herr := RunHooks(ctx, d.Hooks.PostRestore, env.withResult("post_restore", err)); herr != nil && err == nil {
+				err = herr
+			}
+			if err != nil {
+				log.Printf("error restoring %s: %v", it.Path, err)
+				failed++
+			}
+			results[it.Path] = err
+		}
+		if failed > 0 {
+			runErr = fmt.Errorf("failed to restore %d directories", failed)
+		}
+	}
+	if err := RunHooks(ctx, cfg.Hooks.PostRestore, runEnv.withResult("post_restore", runErr)); err != nil && runErr == nil {
+		runErr = err
+	}
+
+	fmt.Println("Results:")
+	for _, it := range items {
+		err, ran := results[it.Path]
+		switch {
+		case !ran:
+			fmt.Printf("  not run  %s\n", it.Path)
+		case err != nil:
+			fmt.Printf("  failed   %s: %v\n", it.Path, err)
+		default:
+			fmt.Printf("  ok       %s\n", it.Path)
+		}
+	}
+	for _, err := range planErrs {
+		fmt.Printf("  skipped  %v\n", err)
+	}
+
+	if runErr != nil || len(planErrs) > 0 {
+		log.Fatal("error: restore incomplete")
+	}
+	log.Printf("restore complete")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPlanRecovery(t *testing.T) {
+	cfg := &Config{Directories: []Directory{{Path: "/opt/pihole/etc-pihole"}, {Path: "/srv/never-backed-up"}}}
+	keys := []string{
+		"cherry/opt-pihole-etc-pihole/2026-02-10T03-00-00Z.tar.gz",
+		"cherry/opt-pihole-etc-pihole/2026-02-11T03-00-00Z.tar.gz",
+		"cherry/opt-homeassistant-config/2026-02-09T03-00-00Z.tar.gz",
+		"cherry/opt-homeassistant-config/2026-02-11T03-00-00Z.tar.gz",
+		"cherry/home-pi-old/2026-02-11T03-00-00Z.tar.gz",
+		"cherry/cmd-system-state/2026-02-11T03-00-00Z.tar.gz",
+		"cherry/cmd-data/2026-02-11T03-00-00Z.tar.gz",
+	}
+	sources := map[string]string{
+		"cherry/cmd-system-state/2026-02-11T03-00-00Z.tar.gz":         "cmd:system-state",
+		"cherry/cmd-data/2026-02-11T03-00-00Z.tar.gz":                 "/cmd-data",
+		"cherry/opt-homeassistant-config/2026-02-09T03-00-00Z.tar.gz": "/opt/homeassistant/config",
+		"cherry/opt-homeassistant-config/2026-02-11T03-00-00Z.tar.gz": "/opt/homeassistant/config",
+	}
+	sourceOf := func(key string) (string, error) { return sources[key], nil }
+
+	items, errs := planRecovery(cfg, "cherry", keys, false, "", "", "/mnt/new", sourceOf)
+	var got []string
+	for _, it := range items {
+		got = append(got, fmt.Sprintf("%s %s %s", it.Path, snapshotName(it.Key), it.Dest))
+	}
+	want := []string{
+		"/cmd-data 2026-02-11T03-00-00Z /mnt/new",
+		"/opt/homeassistant/config 2026-02-11T03-00-00Z /mnt/new/opt/homeassistant",
+		"/opt/pihole/etc-pihole 2026-02-11T03-00-00Z /mnt/new/opt/pihole",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("items:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	// home-pi-old has no recorded source; the command source is left out,
+	// but not the directory whose slug merely looks like one.
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "home-pi-old: not in the config") {
+		t.Errorf("errs = %v", errs)
+	}
+
+	// --at picks per directory; --configured ignores what isn't configured.
+	items, errs = planRecovery(cfg, "cherry", keys, true, "", "2026-02-10T12:00:00Z", "", sourceOf)
+	if len(items) != 1 || snapshotName(items[0].Key) != "2026-02-10T03-00-00Z" || items[0].Dest != "/opt/pihole" {
+		t.Errorf("configured items = %+v", items)
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "/srv/never-backed-up: no backups found") {
+		t.Errorf("configured errs = %v", errs)
+	}
+}
+
+func TestPlanRecoverySourceError(t *testing.T) {
+	keys := []string{"cherry/srv-data/2026-02-11T03-00-00Z.tar.gz"}
+	_, errs := planRecovery(&Config{}, "cherry", keys, false, "", "", "", func(string) (string, error) {
+		return "", errors.New("access denied")
+	})
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "access denied") {
+		t.Errorf("errs = %v", errs)
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	for answer, want := range map[string]bool{"y\n": true, "YES\n": true, "n\n": false, "\n": false, "": false} {
+		if got := confirm(strings.NewReader(answer), "go?"); got != want {
+			t.Errorf("confirm(%q) = %v, want %v", answer, got, want)
+		}
+	}
+}
+
+func TestSourceMetadata(t *testing.T) {
+	for _, source := range []string{"/opt/home assistant/config", "/srv/café", "cmd:system-state"} {
+		v := sourceMetadata(source)
+		for _, r := range v {
+			if r > 127 || r == ' ' {
+				t.Errorf("sourceMetadata(%q) = %q, want ASCII without spaces", source, v)
+				break
+			}
+		}
+		if got, err := url.PathUnescape(v); err != nil || got != source {
+			t.Errorf("round trip of %q = %q, %v", source, got, err)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSuggestions is how many nearby snapshots a failed lookup suggests.
+const maxSuggestions = 3
+
+// atLayouts are the forms --at accepts, most specific first. Times without
+// a zone are local; snapshotTimeFormat's trailing Z is UTC, as in the keys.
+var atLayouts = []string{
+	time.RFC3339,
+	snapshotTimeFormat,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// partialLayouts parse the leading part of a snapshot timestamp, used to
+// find the snapshots closest to one that doesn't exist.
+var partialLayouts = []string{
+	snapshotTimeFormat,
+	"2006-01-02T15-04-05",
+	"2006-01-02T15-04",
+	"2006-01-02T15",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+// snapshotName is the timestamp part of a backup key, as --snapshot takes it.
+func snapshotName(key string) string {
+	return strings.TrimSuffix(path.Base(key), ".tar.gz")
+}
+
+// ResolveSnapshot picks one of a source's backup keys. With at set, it is
+// the newest snapshot taken at or before that time. Otherwise snapshot may
+// be:
+//
+//   - empty or "latest": the newest snapshot
+//   - "previous", or "-N": the one before the newest, or N before it
+//   - a full timestamp such as 2026-02-11T03-00-00Z, which must exist
+//   - a leading part of one such as 2026-02-11 or 2026-02-11T03: the
+//     newest snapshot that starts with it
+//
+// Errors for a snapshot that doesn't exist name the closest ones.
+func ResolveSnapshot(keys []string, snapshot, at string) (string, error) {
+	var snaps []Snapshot
+	for _, k := range keys {
+		if t, err := ParseSnapshotTime(k); err == nil {
+			snaps = append(snaps, Snapshot{Key: k, Time: t})
+		}
+	}
+	if len(snaps) == 0 {
+		return "", fmt.Errorf("no backups found")
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].Time.Before(snaps[j].Time) })
+	newest := len(snaps) - 1
+
+	if at != "" {
+		if snapshot != "" {
+			return "", fmt.Errorf("--at and --snapshot can't be used together")
+		}
+		t, err := parseAt(at)
+		if err != nil {
+			return "", err
+		}
+		for i := newest; i >= 0; i-- {
+			if !snaps[i].Time.After(t) {
+				return snaps[i].Key, nil
+			}
+		}
+		return "", fmt.Errorf("no snapshot at or before %s; the oldest is %s", t.Format(time.RFC3339), snapshotName(snaps[0].Key))
+	}
+
+	switch {
+	case snapshot == "" || snapshot == "latest":
+		return snaps[newest].Key, nil
+	case snapshot == "previous":
+		snapshot = "-1"
+		fallthrough
+	case strings.HasPrefix(snapshot, "-"):
+		n, err := strconv.Atoi(snapshot[1:])
+		if err != nil || n < 0 {
+			return "", fmt.Errorf("bad relative snapshot %q: want -N, e.g. -1 for the one before the latest", snapshot)
+		}
+		if n > newest {
+			return "", fmt.Errorf("snapshot %s: only %d snapshots exist", snapshot, len(snaps))
+		}
+		return snaps[newest-n].Key, nil
+	}
+
+	for i := newest; i >= 0; i-- {
+		if strings.HasPrefix(snapshotName(snaps[i].Key), snapshot) {
+			return snaps[i].Key, nil
+		}
+	}
+	return "", fmt.Errorf("no snapshot matches %q; closest: %s", snapshot, strings.Join(closestSnapshots(snaps, snapshot), ", "))
+}
+
+// parseAt parses an --at time in one of atLayouts. A bare date means the
+// end of that day.
+func parseAt(s string) (time.Time, error) {
+	for _, layout := range atLayouts {
+		loc := time.Local
+		if strings.HasSuffix(layout, "Z") {
+			// A literal Z, not a zone the layout parses.
+			loc = time.UTC
+		}
+		t, err := time.ParseInLocation(layout, s, loc)
+		if err != nil {
+			continue
+		}
+		if layout == "2006-01-02" {
+			t = t.AddDate(0, 0, 1).Add(-time.Second)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("bad --at time %q: want e.g. \"2026-02-01 18:00\" or 2026-02-01", s)
+}
+
+// closestSnapshots returns the names of the snapshots nearest in time to
+// what snapshot looks like it meant, or the newest ones if it doesn't
+// parse at all.
+func closestSnapshots(snaps []Snapshot, snapshot string) []string {
+	var target time.Time
+	parsed := false
+	for _, layout := range partialLayouts {
+		if t, err := time.Parse(layout, snapshot); err == nil {
+			target, parsed = t, true
+			break
+		}
+	}
+
+	sorted := append([]Snapshot(nil), snaps...)
+	if parsed {
+		dist := func(s Snapshot) time.Duration { return s.Time.Sub(target).Abs() }
+		sort.SliceStable(sorted, func(i, j int) bool { return dist(sorted[i]) < dist(sorted[j]) })
+	} else {
+		sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Time.After(sorted[j].Time) })
+	}
+
+	var names []string
+	for i := 0; i < len(sorted) && i < maxSuggestions; i++ {
+		names = append(names, snapshotName(sorted[i].Key))
+	}
+	return names
+}
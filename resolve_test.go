@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var resolveKeys = []string{
+	"host/opt-data/2026-02-09T03-00-00Z.tar.gz",
+	"host/opt-data/2026-02-10T03-00-00Z.tar.gz",
+	"host/opt-data/2026-02-11T03-00-00Z.tar.gz",
+	"host/opt-data/2026-02-11T15-00-00Z.tar.gz",
+	"host/opt-data/2026-02-12T03-00-00Z.tar.gz",
+	"host/opt-data/notes.txt",
+}
+
+func TestResolveSnapshot(t *testing.T) {
+	tests := []struct {
+		snapshot, at string
+		want         string
+	}{
+		{"", "", "2026-02-12T03-00-00Z"},
+		{"latest", "", "2026-02-12T03-00-00Z"},
+		{"previous", "", "2026-02-11T15-00-00Z"},
+		{"-1", "", "2026-02-11T15-00-00Z"},
+		{"-3", "", "2026-02-10T03-00-00Z"},
+		{"-0", "", "2026-02-12T03-00-00Z"},
+		{"2026-02-10T03-00-00Z", "", "2026-02-10T03-00-00Z"},
+		{"2026-02-11", "", "2026-02-11T15-00-00Z"},
+		{"2026-02-11T03", "", "2026-02-11T03-00-00Z"},
+		{"", "2026-02-11T14:59:59Z", "2026-02-11T03-00-00Z"},
+		{"", "2026-02-11T15:00:00Z", "2026-02-11T15-00-00Z"},
+		{"", "2027-01-01T00:00:00Z", "2026-02-12T03-00-00Z"},
+	}
+	for _, tt := range tests {
+		key, err := ResolveSnapshot(resolveKeys, tt.snapshot, tt.at)
+		if err != nil {
+			t.Errorf("ResolveSnapshot(%q, %q): %v", tt.snapshot, tt.at, err)
+			continue
+		}
+		if got := snapshotName(key); got != tt.want {
+			t.Errorf("ResolveSnapshot(%q, %q) = %s, want %s", tt.snapshot, tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestResolveSnapshotErrors(t *testing.T) {
+	tests := []struct {
+		snapshot, at string
+		wantErr      string
+	}{
+		{"-5", "", "only 5 snapshots exist"},
+		{"-x", "", "bad relative snapshot"},
+		{"", "2026-02-01T00:00:00Z", "the oldest is 2026-02-09T03-00-00Z"},
+		{"", "yesterday", "bad --at time"},
+		{"2026-02-11", "2026-02-11", "can't be used together"},
+		// A typo'd day suggests the snapshots nearest to it.
+		{"2026-02-13T03-00-00Z", "", "closest: 2026-02-12T03-00-00Z, 2026-02-11T15-00-00Z, 2026-02-11T03-00-00Z"},
+		// Something that isn't a timestamp at all suggests the newest.
+		{"lastest", "", "closest: 2026-02-12T03-00-00Z, 2026-02-11T15-00-00Z, 2026-02-11T03-00-00Z"},
+	}
+	for _, tt := range tests {
+		_, err := ResolveSnapshot(resolveKeys, tt.snapshot, tt.at)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("ResolveSnapshot(%q, %q) error = %v, want it to contain %q", tt.snapshot, tt.at, err, tt.wantErr)
+		}
+	}
+
+	if _, err := ResolveSnapshot(nil, "", ""); err == nil {
+		t.Error("ResolveSnapshot with no keys: want error")
+	}
+}
+
+func TestParseAtBareDate(t *testing.T) {
+	got, err := parseAt("2026-02-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Day() != 1 || got.Hour() != 23 || got.Minute() != 59 {
+		t.Errorf("parseAt(2026-02-01) = %v, want the end of that day", got)
+	}
+}
+
+func TestParseAtSnapshotTimeIsUTC(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("UTC+5", 5*60*60)
+	t.Cleanup(func() { time.Local = local })
+
+	// Read as local time, this would be 2026-02-10T22:00:00Z and pick the
+	// snapshot from the day before.
+	key, err := ResolveSnapshot(resolveKeys, "", "2026-02-11T03-00-00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := snapshotName(key); got != "2026-02-11T03-00-00Z" {
+		t.Errorf("--at 2026-02-11T03-00-00Z picked %s", got)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"archive/tar"
 	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -12,6 +14,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
@@ -21,10 +24,15 @@ import (
 // ListBackups lists S3 objects under {hostname}/{slug}/ prefix.
 // If dir is empty, lists all backups for the hostname.
 func ListBackups(ctx context.Context, cfg *Config, dir string) ([]string, error) {
-	prefix := cfg.Hostname + "/"
+	return ListHostBackups(ctx, cfg, cfg.Hostname, dir)
+}
+
+// ListHostBackups is ListBackups for the backups of another host.
+func ListHostBackups(ctx context.Context, cfg *Config, host, dir string) ([]string, error) {
+	prefix := host + "/"
 	if dir != "" {
 		slug := PathSlug(dir)
-		prefix = fmt.Sprintf("%s/%s/", cfg.Hostname, slug)
+		prefix = fmt.Sprintf("%s/%s/", host, slug)
 	}
 
 	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(cfg.Region))
@@ -67,6 +75,20 @@ func FindLatestBackup(ctx context.Context, cfg *Config, dir string) (string, err
 	return keys[len(keys)-1], nil
 }
 
+// FindSnapshot returns the key of host's backup of dir selected by
+// snapshot or at; see ResolveSnapshot.
+func FindSnapshot(ctx context.Context, cfg *Config, host, dir, snapshot, at string) (string, error) {
+	keys, err := ListHostBackups(ctx, cfg, host, dir)
+	if err != nil {
+		return "", err
+	}
+	key, err := ResolveSnapshot(keys, snapshot, at)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", dir, err)
+	}
+	return key, nil
+}
+
 // DownloadFromS3 downloads an object from S3 and writes it to w.
 func DownloadFromS3(ctx context.Context, region, bucket, key string, w io.Writer) error {
 	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(region))
@@ -91,9 +113,36 @@ func DownloadFromS3(ctx context.Context, region, bucket, key string, w io.Writer
 	return nil
 }
 
-// ExtractArchive extracts a tar.gz archive from r into destDir.
-// If fileFilter is non-empty, only extract entries matching that path.
-func ExtractArchive(r io.Reader, destDir, fileFilter string) error {
+// ExtractArchive extracts a tar.gz archive from r into destDir, limited
+// and renamed as opts says. Existing files are dealt with by
+// opts.OnConflict, and stale sidecars of restored SQLite databases are
+// removed.
+//
+// Nothing is ever written outside destDir or through a symlink (see
+// rootedDest). Set-user-ID and set-group-ID bits are dropped unless
+// opts.PreserveSpecial is set, device, FIFO and hard link entries are
+// skipped, and the archive fails once it exceeds opts.MaxSize bytes or
+// opts.MaxEntries entries.
+func ExtractArchive(r io.Reader, destDir string, opts ExtractOptions) error {
+	filter, err := newEntryFilter(opts)
+	if err != nil {
+		return err
+	}
+	if err := validateConflictPolicy(opts.OnConflict); err != nil {
+		return err
+	}
+	conflicts := &conflictResolver{
+		policy: opts.OnConflict,
+		dryRun: opts.DryRun,
+		ts:     time.Now().UTC().Format(snapshotTimeFormat),
+	}
+
+	dest, err := openRootedDest(destDir, opts.DryRun)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
 	gr, err := gzip.NewReader(r)
 	if err != nil {
 		return fmt.Errorf("opening gzip: %w", err)
@@ -101,7 +150,9 @@ func ExtractArchive(r io.Reader, destDir, fileFilter string) error {
 	defer gr.Close()
 
 	tr := tar.NewReader(gr)
-	found := false
+	var entries int
+	var size int64
+	var stripped []string
 
 	for {
 		hdr, err := tr.Next()
@@ -112,85 +163,277 @@ func ExtractArchive(r io.Reader, destDir, fileFilter string) error {
 			return fmt.Errorf("reading tar: %w", err)
 		}
 
-		if fileFilter != "" && hdr.Name != fileFilter {
+		name, ok := filter.target(hdr.Name)
+		if !ok {
+			continue
+		}
+		if err := checkRel(name); err != nil {
+			return err
+		}
+		target := dest.path(name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir, tar.TypeReg, tar.TypeSymlink:
+		default:
+			log.Printf("warning: skipping %s: %s entries aren't restored", hdr.Name, entryTypeName(hdr.Typeflag))
 			continue
 		}
-		found = true
 
-		target := filepath.Join(destDir, hdr.Name)
+		entries++
+		if opts.MaxEntries > 0 && entries > opts.MaxEntries {
+			return fmt.Errorf("archive has more than %d entries; raise restore_limits.max_entries or --max-entries if that's expected", opts.MaxEntries)
+		}
+		size += hdr.Size
+		if opts.MaxSize > 0 && size > opts.MaxSize {
+			return fmt.Errorf("archive holds more than %d bytes; raise restore_limits.max_size or --max-size if that's expected", opts.MaxSize)
+		}
+
+		mode := hdr.FileInfo().Mode()
+		perm := mode & (os.ModePerm | os.ModeSticky)
+		if setID := mode & (os.ModeSetuid | os.ModeSetgid); setID != 0 {
+			if opts.PreserveSpecial {
+				perm |= setID
+			} else {
+				stripped = append(stripped, target)
+			}
+		}
 
-		// Prevent path traversal
-		if !strings.HasPrefix(filepath.Clean(target), filepath.Clean(destDir)+string(os.PathSeparator)) &&
-			filepath.Clean(target) != filepath.Clean(destDir) {
-			return fmt.Errorf("invalid path in archive: %s", hdr.Name)
+		// Check the way to the entry before anything looks at the entry
+		// itself, so a symlink can't send the conflict policy elsewhere.
+		if err := dest.parents(name, !opts.DryRun); err != nil {
+			return err
+		}
+		write, err := conflicts.prepare(target, hdr)
+		if err != nil {
+			return err
+		}
+		if !write || opts.DryRun {
+			if write && hdr.Typeflag == tar.TypeReg && isSqliteEntry(tr) {
+				if err := conflicts.removeStaleSidecars(target); err != nil {
+					return err
+				}
+			}
+			continue
 		}
 
 		switch hdr.Typeflag {
 		case tar.TypeDir:
-			if err := os.MkdirAll(target, os.FileMode(hdr.Mode)); err != nil {
-				return fmt.Errorf("creating directory %s: %w", target, err)
+			if err := dest.mkdir(name, perm); err != nil {
+				return err
 			}
 		case tar.TypeReg:
-			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
-				return fmt.Errorf("creating parent directory: %w", err)
-			}
-			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode))
+			f, err := dest.create(name, perm)
 			if err != nil {
-				return fmt.Errorf("creating file %s: %w", target, err)
+				return err
+			}
+			head := &headRecorder{r: tr}
+			if isSparseHeader(hdr) {
+				err = copySparse(f, head, hdr.Size)
+			} else {
+				_, err = io.Copy(f, head)
+			}
+			if err == nil && perm&^os.ModePerm != 0 {
+				err = f.Chmod(perm)
 			}
-			if _, err := io.Copy(f, tr); err != nil {
+			if err != nil {
 				f.Close()
 				return fmt.Errorf("writing file %s: %w", target, err)
 			}
 			f.Close()
-		case tar.TypeSymlink:
-			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
-				return fmt.Errorf("creating parent directory: %w", err)
+			// Keep the archived mtime so --on-conflict keep-newer can
+			// tell restored files from ones changed since.
+			if err := os.Chtimes(target, hdr.ModTime, hdr.ModTime); err != nil {
+				return fmt.Errorf("setting mtime of %s: %w", target, err)
 			}
-			if err := os.Symlink(hdr.Linkname, target); err != nil {
-				return fmt.Errorf("creating symlink %s: %w", target, err)
+			if head.isSqlite() {
+				if err := conflicts.removeStaleSidecars(target); err != nil {
+					return err
+				}
+			}
+		case tar.TypeSymlink:
+			if err := dest.symlink(name, hdr.Linkname); err != nil {
+				return err
 			}
 		}
+	}
 
-		if fileFilter != "" {
-			break // Found and extracted the requested file
-		}
+	if len(stripped) > 0 {
+		log.Printf("dropped set-user-ID/set-group-ID bits from %d entries (use --preserve-special to keep them), e.g. %s", len(stripped), stripped[0])
+	}
+	if conflicts.skipped > 0 && !opts.DryRun {
+		log.Printf("kept %d existing files (--on-conflict %s)", conflicts.skipped, opts.OnConflict)
+	}
+	return filter.finish()
+}
+
+// entryTypeName describes a tar entry type ExtractArchive doesn't restore.
+func entryTypeName(t byte) string {
+	switch t {
+	case tar.TypeChar:
+		return "character device"
+	case tar.TypeBlock:
+		return "block device"
+	case tar.TypeFifo:
+		return "FIFO"
+	case tar.TypeLink:
+		return "hard link"
 	}
+	return fmt.Sprintf("type %q", t)
+}
+
+// headRecorder passes reads through from r, keeping the first bytes so a
+// restored file can be recognised as a SQLite database.
+type headRecorder struct {
+	r    io.Reader
+	head []byte
+}
 
-	if fileFilter != "" && !found {
-		return fmt.Errorf("file %q not found in archive", fileFilter)
+func (h *headRecorder) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	if want := len(sqliteHeader) - len(h.head); want > 0 {
+		h.head = append(h.head, p[:min(n, want)]...)
 	}
+	return n, err
+}
 
-	return nil
+func (h *headRecorder) isSqlite() bool {
+	return string(h.head) == sqliteHeader
+}
+
+// isSqliteEntry reports whether the tar entry being read from r starts
+// with the SQLite header. It consumes the start of the entry.
+func isSqliteEntry(r io.Reader) bool {
+	buf := make([]byte, len(sqliteHeader))
+	_, err := io.ReadFull(r, buf)
+	return err == nil && string(buf) == sqliteHeader
+}
+
+// untrustedMarker is written into the restored directory of an in-place
+// restore whose archive failed its checksum, since the files are already
+// there.
+const untrustedMarker = ".pi-backup-untrusted"
+
+// errChecksumMismatch is returned when a downloaded archive doesn't hash to
+// the checksum recorded when it was uploaded.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// RestoreBackup streams a backup from S3 and extracts it into destDir,
+// without a local copy of the archive. name is the top-level directory
+// the archive restores into destDir (see restoredName). The download is
+// checked against the checksum recorded at upload once it has been
+// extracted; on a mismatch the files are already in place, so an
+// untrustedMarker file describing the failure is left in the restored
+// directory. A later verified restore of the same directory removes it.
+// With opts.DryRun, nothing is written and no marker is left or removed.
+func RestoreBackup(ctx context.Context, cfg *Config, key, destDir, name string, opts ExtractOptions) error {
+	err := restoreStream(ctx, cfg, key, destDir, opts)
+	if opts.DryRun {
+		return err
+	}
+	recordTrust(untrustedDir(destDir, name, opts), cfg.Bucket, key, err)
+	return err
+}
+
+// untrustedDir returns the directory a restore of name into destDir marks
+// untrusted: the restored directory, or destDir itself when
+// StripComponents puts the directory's contents straight into it.
+func untrustedDir(destDir, name string, opts ExtractOptions) string {
+	if opts.StripComponents > 0 {
+		return destDir
+	}
+	return filepath.Join(destDir, name)
 }
 
-// RestoreBackup downloads a backup from S3 and extracts it.
-func RestoreBackup(ctx context.Context, cfg *Config, key, destDir, fileFilter string) error {
-	tmpFile, err := os.CreateTemp("", "pi-restore-*.tar.gz")
+// recordTrust marks dir untrusted after a restore into it that failed its
+// checksum, or removes the mark after one that verified. Other errors
+// leave it as it is.
+func recordTrust(dir, bucket, key string, err error) {
+	if errors.Is(err, errChecksumMismatch) {
+		if merr := markUntrusted(dir, bucket, key, err); merr != nil {
+			log.Printf("warning: %v", merr)
+		}
+		return
+	}
+	if err == nil {
+		if rerr := os.Remove(filepath.Join(dir, untrustedMarker)); rerr == nil {
+			log.Printf("removed %s left by an earlier unverified restore", filepath.Join(dir, untrustedMarker))
+		}
+	}
+}
+
+// restoreStream streams the archive at key into ExtractArchive and checks
+// its checksum at the end; see extractVerified.
+func restoreStream(ctx context.Context, cfg *Config, key, destDir string, opts ExtractOptions) error {
+	info, err := StatObject(ctx, cfg.Region, cfg.Bucket, key)
 	if err != nil {
-		return fmt.Errorf("creating temp file: %w", err)
+		return err
 	}
-	defer os.Remove(tmpFile.Name())
-	defer tmpFile.Close()
+	if info.Hash == "" {
+		log.Printf("warning: no checksum recorded for s3://%s/%s; the download can't be verified", cfg.Bucket, key)
+	}
+
+	log.Printf("downloading s3://%s/%s and extracting to %s", cfg.Bucket, key, destDir)
+	return StreamBackup(ctx, cfg, key, func(r io.Reader) error {
+		return extractVerified(r, destDir, opts, info.Hash)
+	})
+}
 
-	log.Printf("downloading s3://%s/%s", cfg.Bucket, key)
-	if err := DownloadFromS3(ctx, cfg.Region, cfg.Bucket, key, tmpFile); err != nil {
+// extractVerified extracts the archive read from r into destDir, then
+// reads the rest of r and checks that the whole stream hashes to want. An
+// empty want skips the check.
+func extractVerified(r io.Reader, destDir string, opts ExtractOptions, want string) error {
+	h := sha256.New()
+	tr := io.TeeReader(r, h)
+	if err := ExtractArchive(tr, destDir, opts); err != nil {
 		return err
 	}
+	// The tar and gzip readers stop before the end of the stream.
+	if _, err := io.Copy(io.Discard, tr); err != nil {
+		return fmt.Errorf("reading archive: %w", err)
+	}
+	if got := fmt.Sprintf("%x", h.Sum(nil)); want != "" && got != want {
+		return fmt.Errorf("%w: recorded sha256 %s, downloaded %s", errChecksumMismatch, want, got)
+	}
+	return nil
+}
 
-	if _, err := tmpFile.Seek(0, 0); err != nil {
-		return fmt.Errorf("seeking temp file: %w", err)
+// markUntrusted leaves an untrustedMarker in dir explaining why the files
+// restored there from key can't be trusted.
+func markUntrusted(dir, bucket, key string, cause error) error {
+	p := filepath.Join(dir, untrustedMarker)
+	msg := fmt.Sprintf("Files restored here from s3://%s/%s at %s may be corrupt: %v.\nRestore them again before relying on them.\n",
+		bucket, key, time.Now().UTC().Format(time.RFC3339), cause)
+	if err := os.WriteFile(p, []byte(msg), 0644); err != nil {
+		return fmt.Errorf("marking %s untrusted: %w", dir, err)
 	}
+	log.Printf("wrote %s", p)
+	return nil
+}
+
+// addFromHostFlag adds --from-host, defaulting to this host, to fs.
+func addFromHostFlag(fs *flag.FlagSet, cfg *Config) *string {
+	return fs.String("from-host", cfg.Hostname, "use the backups of this host instead of this one's (e.g. a replaced device)")
+}
 
-	log.Printf("extracting to %s", destDir)
-	return ExtractArchive(tmpFile, destDir, fileFilter)
+// restoredName is the name of the top-level directory in source's
+// archives: the directory's base name, or a command source's name.
+func restoredName(source string) string {
+	if name, ok := strings.CutPrefix(source, commandPrefix); ok {
+		return name
+	}
+	return filepath.Base(source)
 }
 
 // runRestore handles the "restore" subcommand.
-func runRestore(cfg *Config, args []string) {
+func runRestore(cfg *Config, configPath string, args []string) {
 	if len(args) == 0 {
-		fmt.Fprintf(os.Stderr, "Usage: pi-backup restore list [<directory>]\n")
-		fmt.Fprintf(os.Stderr, "       pi-backup restore <directory> [--snapshot <TS>] [--file <path>] [--dest <dir>]\n")
+		fmt.Fprintf(os.Stderr, "Usage: pi-backup restore list [<directory>] [--from-host <name>]\n")
+		fmt.Fprintf(os.Stderr, "       pi-backup restore ls <directory> [--snapshot <TS>|--at <time>] [--from-host <name>] [<path>]\n")
+		fmt.Fprintf(os.Stderr, "       pi-backup restore cat <directory> [--snapshot <TS>|--at <time>] [--from-host <name>] <path>\n")
+		fmt.Fprintf(os.Stderr, "       pi-backup restore download <directory> [--snapshot <TS>|--at <time>] [--from-host <name>] [--format raw|tar|zip] [--output <file>|-]\n")
+		fmt.Fprintf(os.Stderr, "       pi-backup restore <directory> [--snapshot <TS>|--at <time>] [--file|--include|--exclude <pattern>]... [--strip-components <N>] [--on-conflict <policy>] [--dry-run] [--preserve-special] [--max-size <N>] [--max-entries <N>] [--dest <dir>] [--from-host <name>] [--swap] [--wait]\n")
+		fmt.Fprintf(os.Stderr, "       pi-backup restore <directory> --rollback [--dest <dir>]\n")
+		fmt.Fprintf(os.Stderr, "       pi-backup restore --all [--from-host <name>] [--configured] [--snapshot <TS>|--at <time>] [--root <dir>] [--yes]\n")
 		os.Exit(1)
 	}
 
@@ -198,11 +441,14 @@ func runRestore(cfg *Config, args []string) {
 
 	// Handle "restore list"
 	if args[0] == "list" {
+		fs := flag.NewFlagSet("restore list", flag.ExitOnError)
+		fromHost := addFromHostFlag(fs, cfg)
+		positional := parseInterspersed(fs, args[1:])
 		dir := ""
-		if len(args) > 1 {
-			dir = args[1]
+		if len(positional) > 0 {
+			dir = positional[0]
 		}
-		keys, err := ListBackups(ctx, cfg, dir)
+		keys, err := ListHostBackups(ctx, cfg, *fromHost, dir)
 		if err != nil {
 			log.Fatalf("error: %v", err)
 		}
@@ -220,27 +466,74 @@ func runRestore(cfg *Config, args []string) {
 		return
 	}
 
+	// Handle "restore --all", wherever the flag is
+	for i, a := range args {
+		if a == "--all" || a == "-all" {
+			rest := append(append([]string{}, args[:i]...), args[i+1:]...)
+			runRestoreAll(cfg, configPath, rest)
+			return
+		}
+	}
+
+	// Handle "restore ls" and "restore cat"
+	if args[0] == "ls" || args[0] == "cat" {
+		runBrowse(cfg, args[0], args[1:])
+		return
+	}
+
+	// Handle "restore download"
+	if args[0] == "download" {
+		runDownload(cfg, args[1:])
+		return
+	}
+
 	// Handle "restore <directory>"
 	dir := args[0]
 
 	fs := flag.NewFlagSet("restore", flag.ExitOnError)
-	snapshot := fs.String("snapshot", "", "restore a specific snapshot (timestamp like 2026-02-11T03-00-00Z)")
-	fileFilter := fs.String("file", "", "extract only this file from the archive")
+	snapshot := fs.String("snapshot", "", "restore a specific snapshot: a timestamp like 2026-02-11T03-00-00Z or a leading part of one like 2026-02-11, \"latest\", \"previous\" or -N")
+	at := fs.String("at", "", "restore the newest snapshot taken at or before this local time, e.g. \"2026-02-01 18:00\"")
+	fromHost := addFromHostFlag(fs, cfg)
+	extract := cfg.ExtractOptions()
+	fs.Var((*stringsFlag)(&extract.Files), "file", "extract only this path, directory or glob from the archive (repeatable); fails if it matches nothing")
+	fs.Var((*stringsFlag)(&extract.Include), "include", "extract only entries matching this path, directory or glob (repeatable)")
+	fs.Var((*stringsFlag)(&extract.Exclude), "exclude", "skip entries matching this path, directory or glob (repeatable)")
+	fs.IntVar(&extract.StripComponents, "strip-components", 0, "remove this many leading path components from extracted names")
 	dest := fs.String("dest", "", "extract to alternate location (default: parent of directory)")
+	fs.StringVar(&extract.OnConflict, "on-conflict", ConflictOverwrite, "what to do with files that already exist: overwrite, skip, keep-newer, rename or fail")
+	fs.BoolVar(&extract.PreserveSpecial, "preserve-special", false, "keep set-user-ID and set-group-ID bits on restored files")
+	fs.Var((*ByteSize)(&extract.MaxSize), "max-size", "fail if the archive holds more than this many bytes, e.g. 10G (default: restore_limits.max_size, or no limit)")
+	fs.IntVar(&extract.MaxEntries, "max-entries", extract.MaxEntries, "fail if the archive has more than this many entries (default: restore_limits.max_entries)")
+	fs.BoolVar(&extract.DryRun, "dry-run", false, "log which files would be created, overwritten, skipped or removed without writing anything")
+	swap := fs.Bool("swap", false, "extract into a staging directory, then swap it in place of the live directory, keeping the old one as <dir>.pre-restore-<TS>")
+	rollback := fs.Bool("rollback", false, "undo the last --swap restore, moving <dir>.pre-restore-<TS> back into place")
+	lockOpts := addLockFlags(fs)
 	fs.Parse(args[1:])
 
-	// Determine the S3 key
-	var key string
-	if *snapshot != "" {
-		slug := PathSlug(dir)
-		key = fmt.Sprintf("%s/%s/%s.tar.gz", cfg.Hostname, slug, *snapshot)
-	} else {
-		var err error
-		key, err = FindLatestBackup(ctx, cfg, dir)
-		if err != nil {
-			log.Fatalf("error: %v", err)
-		}
+	filtered := len(extract.Files) > 0 || len(extract.Include) > 0 || len(extract.Exclude) > 0 || extract.StripComponents != 0
+	if *swap && filtered {
+		log.Fatal("error: --swap restores whole directories and can't be combined with --file, --include, --exclude or --strip-components")
+	}
+	if *rollback && (*swap || filtered || *snapshot != "" || *at != "" || *fromHost != cfg.Hostname) {
+		log.Fatal("error: --rollback can't be combined with --swap, --file, --include, --exclude, --strip-components, --snapshot, --at or --from-host")
+	}
+	if (*swap || *rollback) && (extract.DryRun || extract.OnConflict != ConflictOverwrite) {
+		log.Fatal("error: --swap and --rollback replace whole directories and can't be combined with --dry-run or --on-conflict")
+	}
+	if err := validateConflictPolicy(extract.OnConflict); err != nil {
+		log.Fatalf("error: %v", err)
 	}
+	if *snapshot != "" && *at != "" {
+		log.Fatal("error: --snapshot and --at can't be combined")
+	}
+
+	// Listing is read-only, but a restore mustn't write into a directory
+	// that a backup is archiving.
+	lock, err := AcquireLock(LockPath(configPath), "restore", *lockOpts)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	defer lock.Release()
 
 	// Determine destination directory
 	destDir := filepath.Dir(dir)
@@ -248,9 +541,66 @@ func runRestore(cfg *Config, args []string) {
 		destDir = *dest
 	}
 
-	if err := RestoreBackup(ctx, cfg, key, destDir, *fileFilter); err != nil {
+	// Determine the S3 key (a rollback downloads nothing)
+	var key string
+	switch {
+	case *rollback:
+	default:
+		key, err = FindSnapshot(ctx, cfg, *fromHost, dir, *snapshot, *at)
+		if err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		if *snapshot != "" || *at != "" {
+			log.Printf("selected snapshot %s", snapshotName(key))
+		}
+	}
+
+	// Run-wide hooks wrap the directory's own hooks, mirroring backups.
+	d, _ := cfg.FindDirectory(dir)
+	dirHooks := d.Hooks
+	restore := func() error {
+		switch {
+		case *rollback:
+			target := filepath.Join(destDir, restoredName(dir))
+			undone, err := RollbackRestore(target)
+			if err == nil && undone != "" {
+				log.Printf("the rolled-back restore is kept at %s", undone)
+			}
+			return err
+		case *swap:
+			target, aside, err := SwapRestore(ctx, cfg, key, destDir, extract, verifyRestored(d))
+			if err == nil {
+				log.Printf("restored %s", target)
+				if aside != "" {
+					log.Printf("the previous %s is kept at %s; undo with --rollback", target, aside)
+				}
+			}
+			return err
+		default:
+			return RestoreBackup(ctx, cfg, key, destDir, restoredName(dir), extract)
+		}
+	}
+	env := HookEnv{Phase: "pre_restore", Hostname: cfg.Hostname, Bucket: cfg.Bucket, Directory: dir, Key: key, Dest: destDir, DryRun: extract.DryRun}
+
+	err = RunHooks(ctx, cfg.Hooks.PreRestore, env)
+	if err == nil {
+		if err = RunHooks(ctx, dirHooks.PreRestore, env); err == nil {
+			err = restore()
+		}
+		if herr := RunHooks(ctx, dirHooks.PostRestore, env.withResult("post_restore", err)); herr != nil && err == nil {
+			err = herr
+		}
+	}
+	if herr := RunHooks(ctx, cfg.Hooks.PostRestore, env.withResult("post_restore", err)); herr != nil && err == nil {
+		err = herr
+	}
+	if err != nil {
 		log.Fatalf("error: %v", err)
 	}
 
+	if extract.DryRun {
+		log.Printf("[dry-run] nothing was written")
+		return
+	}
 	log.Printf("restore complete")
 }
@@ -2,8 +2,12 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -17,13 +21,13 @@ func TestExtractArchive(t *testing.T) {
 
 	// Create archive
 	var buf bytes.Buffer
-	if err := CreateArchive(&buf, dataDir, nil, nil); err != nil {
+	if _, err := CreateArchive(&buf, dataDir, nil, nil, ArchiveOptions{}); err != nil {
 		t.Fatalf("CreateArchive: %v", err)
 	}
 
 	// Extract to a new temp dir
 	destDir := t.TempDir()
-	if err := ExtractArchive(&buf, destDir, ""); err != nil {
+	if err := ExtractArchive(&buf, destDir, ExtractOptions{}); err != nil {
 		t.Fatalf("ExtractArchive: %v", err)
 	}
 
@@ -55,13 +59,13 @@ func TestExtractArchiveSingleFile(t *testing.T) {
 
 	// Create archive
 	var buf bytes.Buffer
-	if err := CreateArchive(&buf, dataDir, nil, nil); err != nil {
+	if _, err := CreateArchive(&buf, dataDir, nil, nil, ArchiveOptions{}); err != nil {
 		t.Fatalf("CreateArchive: %v", err)
 	}
 
 	// Extract only file2.txt
 	destDir := t.TempDir()
-	if err := ExtractArchive(&buf, destDir, "mydata/subdir/file2.txt"); err != nil {
+	if err := ExtractArchive(&buf, destDir, ExtractOptions{Files: []string{"mydata/subdir/file2.txt"}}); err != nil {
 		t.Fatalf("ExtractArchive: %v", err)
 	}
 
@@ -89,13 +93,13 @@ func TestExtractArchiveNonexistentFile(t *testing.T) {
 
 	// Create archive
 	var buf bytes.Buffer
-	if err := CreateArchive(&buf, dataDir, nil, nil); err != nil {
+	if _, err := CreateArchive(&buf, dataDir, nil, nil, ArchiveOptions{}); err != nil {
 		t.Fatalf("CreateArchive: %v", err)
 	}
 
 	// Try to extract a file that doesn't exist in the archive
 	destDir := t.TempDir()
-	err := ExtractArchive(&buf, destDir, "mydata/nonexistent.txt")
+	err := ExtractArchive(&buf, destDir, ExtractOptions{Files: []string{"mydata/nonexistent.txt"}})
 	if err == nil {
 		t.Fatal("expected error for nonexistent file")
 	}
@@ -103,3 +107,88 @@ func TestExtractArchiveNonexistentFile(t *testing.T) {
 		t.Errorf("expected 'not found in archive' error, got: %v", err)
 	}
 }
+
+func TestExtractVerified(t *testing.T) {
+	srcDir := t.TempDir()
+	dataDir := filepath.Join(srcDir, "mydata")
+	os.MkdirAll(dataDir, 0755)
+	os.WriteFile(filepath.Join(dataDir, "file1.txt"), []byte("content1"), 0644)
+
+	var buf bytes.Buffer
+	if _, err := CreateArchive(&buf, dataDir, nil, nil, ArchiveOptions{}); err != nil {
+		t.Fatalf("CreateArchive: %v", err)
+	}
+	h := sha256.Sum256(buf.Bytes())
+	hash := fmt.Sprintf("%x", h)
+
+	// The tar reader stops at the end-of-archive marker; the hash must still
+	// cover the whole stream, including --file restores that skip most of it.
+	for _, opts := range []ExtractOptions{{}, {Files: []string{"mydata/file1.txt"}}} {
+		if err := extractVerified(bytes.NewReader(buf.Bytes()), t.TempDir(), opts, hash); err != nil {
+			t.Errorf("extractVerified(%+v) with the right hash: %v", opts, err)
+		}
+	}
+	if err := extractVerified(bytes.NewReader(buf.Bytes()), t.TempDir(), ExtractOptions{}, ""); err != nil {
+		t.Errorf("extractVerified with no recorded hash: %v", err)
+	}
+
+	dest := t.TempDir()
+	err := extractVerified(bytes.NewReader(buf.Bytes()), dest, ExtractOptions{}, strings.Repeat("0", 64))
+	if !errors.Is(err, errChecksumMismatch) {
+		t.Fatalf("err = %v, want errChecksumMismatch", err)
+	}
+	// The files are extracted all the same; RestoreBackup marks them.
+	if _, err := os.Stat(filepath.Join(dest, "mydata", "file1.txt")); err != nil {
+		t.Errorf("file1.txt not extracted: %v", err)
+	}
+}
+
+func TestMarkUntrusted(t *testing.T) {
+	dest := t.TempDir()
+	cause := fmt.Errorf("%w: recorded sha256 aa, downloaded bb", errChecksumMismatch)
+	if err := markUntrusted(dest, "bucket", "host/opt-data/2026-02-11T03-00-00Z.tar.gz", cause); err != nil {
+		t.Fatalf("markUntrusted: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(dest, untrustedMarker))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"s3://bucket/host/opt-data/2026-02-11T03-00-00Z.tar.gz", "recorded sha256 aa, downloaded bb"} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("marker %q missing %q", got, want)
+		}
+	}
+}
+
+func TestRecordTrust(t *testing.T) {
+	dest := t.TempDir()
+	a := untrustedDir(dest, "a", ExtractOptions{})
+	b := untrustedDir(dest, "b", ExtractOptions{})
+	os.MkdirAll(a, 0755)
+	os.MkdirAll(b, 0755)
+	captureLog(t)
+
+	mismatch := fmt.Errorf("%w: recorded sha256 aa, downloaded bb", errChecksumMismatch)
+	recordTrust(a, "bucket", "host/a/1.tar.gz", mismatch)
+	marker := filepath.Join(a, untrustedMarker)
+	if _, err := os.Stat(marker); err != nil {
+		t.Fatalf("no marker after a mismatch: %v", err)
+	}
+
+	// A verified restore of another directory into the same destination
+	// leaves the mark alone, as does a restore of a that failed otherwise.
+	recordTrust(b, "bucket", "host/b/1.tar.gz", nil)
+	recordTrust(a, "bucket", "host/a/1.tar.gz", errors.New("connection reset"))
+	if _, err := os.Stat(marker); err != nil {
+		t.Fatalf("marker removed by another restore: %v", err)
+	}
+
+	recordTrust(a, "bucket", "host/a/2.tar.gz", nil)
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Errorf("marker survived a verified restore of a: %v", err)
+	}
+
+	if got := untrustedDir(dest, "a", ExtractOptions{StripComponents: 1}); got != dest {
+		t.Errorf("untrustedDir with strip-components = %s, want %s", got, dest)
+	}
+}
@@ -1,10 +1,20 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
 // SnapshotResult captures the override and exclude paths that result from
@@ -16,12 +26,16 @@ type SnapshotResult struct {
 	Cleanup   func()
 }
 
-// PrepareSnapshots takes online .backup snapshots of every SQLite file in d
+// PrepareSnapshots takes online snapshots of every SQLite file in d
 // and returns the overrides and implicit excludes (the -wal/-shm/-journal
 // siblings) needed to splice them into an archive of d.Path. The caller must
 // invoke result.Cleanup when done.
 //
-// If d declares no sqlite files, this returns an empty result with a no-op
+// With d.SqliteAutodetect, databases found by scanning d.Path are
+// snapshotted too, and any that aren't declared in d.SqliteFiles are logged
+// so they can be pinned in the config.
+//
+// If d has no sqlite files, this returns an empty result with a no-op
 // cleanup. User-defined excludes from d are also folded into the result.
 func PrepareSnapshots(d Directory) (*SnapshotResult, error) {
 	res := &SnapshotResult{
@@ -35,7 +49,26 @@ func PrepareSnapshots(d Directory) (*SnapshotResult, error) {
 		res.Excludes[filepath.Join(d.Path, rel)] = true
 	}
 
-	if len(d.SqliteFiles) == 0 {
+	sqliteFiles := slices.Clone(d.SqliteFiles)
+	if d.SqliteAutodetect {
+		detected, err := detectSqliteFiles(d.Path, res.Excludes, d.ArchiveOptions())
+		if err != nil {
+			return nil, fmt.Errorf("detecting sqlite files: %w", err)
+		}
+		declared := map[string]bool{}
+		for _, rel := range d.SqliteFiles {
+			declared[filepath.Clean(rel)] = true
+		}
+		for _, rel := range detected {
+			if declared[rel] {
+				continue
+			}
+			log.Printf("%s: found undeclared SQLite database %s; add it to sqlite_files to pin it", d.Path, rel)
+			sqliteFiles = append(sqliteFiles, rel)
+		}
+	}
+
+	if len(sqliteFiles) == 0 {
 		return res, nil
 	}
 
@@ -45,42 +78,194 @@ func PrepareSnapshots(d Directory) (*SnapshotResult, error) {
 	}
 	res.Cleanup = func() { os.RemoveAll(tmpDir) }
 
-	for _, rel := range d.SqliteFiles {
+	for _, rel := range sqliteFiles {
 		live := filepath.Join(d.Path, rel)
 		// Snapshot filename mirrors the relative path so collisions are
 		// impossible across multiple DBs in the same dir.
-		snap := filepath.Join(tmpDir, filepath.Base(rel))
+		snap := filepath.Join(tmpDir, filepath.Clean(rel))
 		if _, exists := res.Overrides[live]; exists {
 			res.Cleanup()
 			return nil, fmt.Errorf("duplicate sqlite_file entry: %s", rel)
 		}
+		if err := os.MkdirAll(filepath.Dir(snap), 0700); err != nil {
+			res.Cleanup()
+			return nil, fmt.Errorf("creating snapshot dir: %w", err)
+		}
 		if err := snapshotSqlite(live, snap); err != nil {
 			res.Cleanup()
 			return nil, fmt.Errorf("snapshotting %s: %w", live, err)
 		}
 		res.Overrides[live] = snap
 		// Implicit excludes for the WAL/SHM/journal siblings.
-		for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		for _, suffix := range sqliteSidecarSuffixes {
 			res.Excludes[live+suffix] = true
 		}
 	}
 	return res, nil
 }
 
-// snapshotSqlite invokes `sqlite3 src ".backup dest"`. The sqlite3 CLI uses
-// SQLite's online backup API: it copies pages while holding a shared lock
-// and retries pages that change mid-copy. The resulting file is a single
-// self-contained .db with no WAL/SHM siblings.
+// sqliteHeader is the magic string at the start of every SQLite 3 database.
+const sqliteHeader = "SQLite format 3\x00"
+
+// sqliteSidecarSuffixes name the files SQLite keeps next to a database.
+var sqliteSidecarSuffixes = []string{"-wal", "-shm", "-journal"}
+
+// detectSqliteFiles walks dir the way the archive will and returns the
+// paths, relative to dir, of files that look like SQLite databases: they
+// start with the SQLite header or have a -wal sibling. Entries that can't
+// be read are ignored here; the archive walk deals with them.
+func detectSqliteFiles(dir string, excludes map[string]bool, opts ArchiveOptions) ([]string, error) {
+	var found []string
+	err := walkTree(dir, opts, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if excludes[path] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || !isSqliteFile(path) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		found = append(found, rel)
+		return nil
+	})
+	return found, err
+}
+
+// isSqliteFile reports whether path starts with the SQLite header or has a
+// write-ahead log next to it.
+func isSqliteFile(path string) bool {
+	if strings.HasSuffix(path, "-wal") || strings.HasSuffix(path, "-shm") || strings.HasSuffix(path, "-journal") {
+		return false
+	}
+	if _, err := os.Lstat(path + "-wal"); err == nil {
+		return true
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	buf := make([]byte, len(sqliteHeader))
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return false
+	}
+	return string(buf) == sqliteHeader
+}
+
+// SQLite snapshot tuning. The busy timeout covers brief write locks held
+// by the application; retries cover longer ones, such as a checkpoint.
+const (
+	sqliteBusyTimeout = 10 * time.Second
+	sqliteRetries     = 3
+	sqliteRetryDelay  = 2 * time.Second
+)
+
+// snapshotSqlite copies the database at src to dest with `VACUUM INTO`,
+// which runs in a read transaction and so produces a consistent,
+// self-contained .db with no WAL/SHM siblings, even while the application
+// keeps writing. The snapshot is then checked with PRAGMA integrity_check so
+// a corrupt database fails the backup instead of being uploaded.
 func snapshotSqlite(src, dest string) error {
 	if _, err := os.Stat(src); err != nil {
 		return fmt.Errorf("source missing: %w", err)
 	}
-	// .backup with quoted dest path. sqlite3 understands the path verbatim
-	// when single-quoted; escape any single quotes in dest to be safe.
-	cmd := exec.Command("sqlite3", src, fmt.Sprintf(".backup '%s'", dest))
-	out, err := cmd.CombinedOutput()
+
+	var err error
+	for attempt := 1; attempt <= sqliteRetries; attempt++ {
+		if err = vacuumInto(src, dest); err == nil || !isSqliteBusy(err) {
+			break
+		}
+		log.Printf("warning: %s is busy (attempt %d/%d): %v", src, attempt, sqliteRetries, err)
+		os.Remove(dest)
+		time.Sleep(sqliteRetryDelay)
+	}
 	if err != nil {
-		return fmt.Errorf("sqlite3 .backup: %w: %s", err, string(out))
+		return fmt.Errorf("VACUUM INTO: %w", err)
+	}
+
+	if err := checkSqliteIntegrity(dest); err != nil {
+		return fmt.Errorf("snapshot of %s: %w", src, err)
 	}
 	return nil
 }
+
+// openSqlite opens the database at path without creating it.
+func openSqlite(path string, readOnly bool) (*sql.DB, error) {
+	mode := "rw"
+	if readOnly {
+		mode = "ro"
+	}
+	q := url.Values{}
+	q.Set("mode", mode)
+	q.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", sqliteBusyTimeout.Milliseconds()))
+	u := url.URL{Scheme: "file", OmitHost: true, Path: path, RawQuery: q.Encode()}
+
+	db, err := sql.Open("sqlite", u.String())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+func vacuumInto(src, dest string) error {
+	db, err := openSqlite(src, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec("VACUUM INTO ?", dest)
+	return err
+}
+
+// checkSqliteIntegrity runs PRAGMA integrity_check against the database
+// at path and returns an error listing the problems it reports.
+func checkSqliteIntegrity(path string) error {
+	db, err := openSqlite(path, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return fmt.Errorf("integrity check: %w", err)
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			return fmt.Errorf("integrity check: %w", err)
+		}
+		if msg != "ok" {
+			problems = append(problems, msg)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("integrity check: %w", err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("integrity check failed: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// isSqliteBusy reports whether err is SQLITE_BUSY or SQLITE_LOCKED.
+func isSqliteBusy(err error) bool {
+	var serr *sqlite.Error
+	if !errors.As(err, &serr) {
+		return false
+	}
+	code := serr.Code() & 0xff // primary result code
+	return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+}
@@ -4,35 +4,51 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"database/sql"
+	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
-func requireSqlite3(t *testing.T) {
-	t.Helper()
-	if _, err := exec.LookPath("sqlite3"); err != nil {
-		t.Skip("sqlite3 not on PATH")
-	}
-}
-
-// makeSqliteDB writes a small SQLite database at path with one inserted row.
+// makeSqliteDB writes a small WAL-mode SQLite database at path with one
+// inserted row.
 func makeSqliteDB(t *testing.T, path string) {
 	t.Helper()
-	cmd := exec.Command("sqlite3", path,
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("opening sqlite db: %v", err)
+	}
+	defer db.Close()
+	for _, stmt := range []string{
 		"PRAGMA journal_mode=WAL;",
 		"CREATE TABLE t (id INTEGER PRIMARY KEY, v TEXT);",
 		"INSERT INTO t (v) VALUES ('hello');",
-	)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		t.Fatalf("seeding sqlite db: %v\n%s", err, out)
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("seeding sqlite db: %v", err)
+		}
+	}
+}
+
+// queryOne returns the single text value produced by query against path.
+func queryOne(t *testing.T, path, query string) string {
+	t.Helper()
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("opening %s: %v", path, err)
+	}
+	defer db.Close()
+	var v string
+	if err := db.QueryRow(query).Scan(&v); err != nil {
+		t.Fatalf("querying %s: %v", path, err)
 	}
+	return v
 }
 
 func TestSnapshotSqlite(t *testing.T) {
-	requireSqlite3(t)
 	dir := t.TempDir()
 	src := filepath.Join(dir, "data.db")
 	dest := filepath.Join(dir, "snap.db")
@@ -43,17 +59,84 @@ func TestSnapshotSqlite(t *testing.T) {
 	}
 
 	// Snapshot should be readable as a SQLite DB and contain the row.
-	out, err := exec.Command("sqlite3", dest, "SELECT v FROM t;").CombinedOutput()
+	if got := queryOne(t, dest, "SELECT v FROM t;"); got != "hello" {
+		t.Errorf("snapshot content = %q, want %q", got, "hello")
+	}
+	// It must be self-contained: no WAL or SHM left next to it.
+	for _, suf := range []string{"-wal", "-shm"} {
+		if _, err := os.Stat(dest + suf); !os.IsNotExist(err) {
+			t.Errorf("snapshot has a %s sibling", suf)
+		}
+	}
+}
+
+func TestSnapshotSqliteSeesUncheckpointedWAL(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "data.db")
+	makeSqliteDB(t, src)
+
+	// Keep a writer open so the latest row lives only in the WAL.
+	db, err := sql.Open("sqlite", src+"?_pragma=wal_autocheckpoint(0)")
 	if err != nil {
-		t.Fatalf("reading snapshot: %v\n%s", err, out)
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("INSERT INTO t (v) VALUES ('from-wal')"); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(dir, "snap.db")
+	if err := snapshotSqlite(src, dest); err != nil {
+		t.Fatalf("snapshotSqlite: %v", err)
+	}
+	if got := queryOne(t, dest, "SELECT count(*) FROM t;"); got != "2" {
+		t.Errorf("snapshot row count = %s, want 2", got)
+	}
+}
+
+func TestSnapshotSqliteQuotesPath(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "it's a dir")
+	os.MkdirAll(dir, 0755)
+	src := filepath.Join(dir, "data.db")
+	makeSqliteDB(t, src)
+
+	dest := filepath.Join(dir, "o'snap #1.db")
+	if err := snapshotSqlite(src, dest); err != nil {
+		t.Fatalf("snapshotSqlite: %v", err)
 	}
-	if got := string(bytes.TrimSpace(out)); got != "hello" {
+	if got := queryOne(t, dest, "SELECT v FROM t;"); got != "hello" {
 		t.Errorf("snapshot content = %q, want %q", got, "hello")
 	}
 }
 
+func TestSnapshotSqliteCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "data.db")
+	db, err := sql.Open("sqlite", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY, v TEXT);")
+	db.Exec("CREATE INDEX t_v ON t (v);")
+	for i := 0; i < 200; i++ {
+		db.Exec("INSERT INTO t (v) VALUES (?)", strings.Repeat("x", 100)+fmt.Sprint(i))
+	}
+	db.Close()
+
+	// Scribble over the middle of the file, past the schema page.
+	f, err := os.OpenFile(src, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt(bytes.Repeat([]byte{0xff}, 4096), 8192)
+	f.Close()
+
+	if err := snapshotSqlite(src, filepath.Join(dir, "snap.db")); err == nil {
+		t.Fatal("expected snapshot of a corrupt database to fail")
+	}
+}
+
 func TestPrepareSnapshots(t *testing.T) {
-	requireSqlite3(t)
 	dir := t.TempDir()
 	dbPath := filepath.Join(dir, "data.db")
 	makeSqliteDB(t, dbPath)
@@ -89,8 +172,96 @@ func TestPrepareSnapshots(t *testing.T) {
 	}
 }
 
+func TestPrepareSnapshotsSameBasename(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "a"), 0755)
+	os.MkdirAll(filepath.Join(dir, "b"), 0755)
+	makeSqliteDB(t, filepath.Join(dir, "a", "data.db"))
+	makeSqliteDB(t, filepath.Join(dir, "b", "data.db"))
+
+	res, err := PrepareSnapshots(Directory{Path: dir, SqliteFiles: []string{"a/data.db", "b/data.db"}})
+	if err != nil {
+		t.Fatalf("PrepareSnapshots: %v", err)
+	}
+	defer res.Cleanup()
+
+	a := res.Overrides[filepath.Join(dir, "a", "data.db")]
+	b := res.Overrides[filepath.Join(dir, "b", "data.db")]
+	if a == "" || b == "" || a == b {
+		t.Errorf("overrides = %v, want distinct snapshots for each database", res.Overrides)
+	}
+}
+
+func TestPrepareSnapshotsAutodetect(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "nested"), 0755)
+	declared := filepath.Join(dir, "declared.db")
+	found := filepath.Join(dir, "nested", "new_v3.db")
+	skipped := filepath.Join(dir, "excluded.db")
+	makeSqliteDB(t, declared)
+	makeSqliteDB(t, found)
+	makeSqliteDB(t, skipped)
+	// No header, but a -wal sibling marks it as a database.
+	walOnly := filepath.Join(dir, "walonly.sqlite")
+	os.WriteFile(walOnly, nil, 0644)
+	os.WriteFile(walOnly+"-wal", nil, 0644)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("SQLite is nice"), 0644)
+
+	detected, err := detectSqliteFiles(dir, map[string]bool{skipped: true}, ArchiveOptions{})
+	if err != nil {
+		t.Fatalf("detectSqliteFiles: %v", err)
+	}
+	want := []string{"declared.db", "nested/new_v3.db", "walonly.sqlite"}
+	if !equalSlice(detected, want) {
+		t.Errorf("detected = %v, want %v", detected, want)
+	}
+
+	d := Directory{
+		Path:             dir,
+		SqliteFiles:      []string{"declared.db"},
+		SqliteAutodetect: true,
+		Excludes:         []string{"excluded.db"},
+	}
+	res, err := PrepareSnapshots(d)
+	if err != nil {
+		t.Fatalf("PrepareSnapshots: %v", err)
+	}
+	defer res.Cleanup()
+
+	for _, p := range []string{declared, found, walOnly} {
+		if _, ok := res.Overrides[p]; !ok {
+			t.Errorf("missing override for %s", p)
+		}
+		if !res.Excludes[p+"-wal"] {
+			t.Errorf("expected exclude for %s-wal", p)
+		}
+	}
+	if _, ok := res.Overrides[skipped]; ok {
+		t.Error("excluded database should not be snapshotted")
+	}
+	if len(d.SqliteFiles) != 1 {
+		t.Errorf("PrepareSnapshots modified d.SqliteFiles: %v", d.SqliteFiles)
+	}
+}
+
+func TestIsSqliteFile(t *testing.T) {
+	dir := t.TempDir()
+	db := filepath.Join(dir, "real.db")
+	makeSqliteDB(t, db)
+	if !isSqliteFile(db) {
+		t.Error("real database not detected")
+	}
+	if isSqliteFile(db + "-wal") {
+		t.Error("-wal file detected as a database")
+	}
+	txt := filepath.Join(dir, "short.txt")
+	os.WriteFile(txt, []byte("SQLite"), 0644)
+	if isSqliteFile(txt) {
+		t.Error("short text file detected as a database")
+	}
+}
+
 func TestCreateArchiveWithOverrideAndExclude(t *testing.T) {
-	requireSqlite3(t)
 	parent := t.TempDir()
 	dir := filepath.Join(parent, "data")
 	os.MkdirAll(dir, 0755)
@@ -115,7 +286,7 @@ func TestCreateArchiveWithOverrideAndExclude(t *testing.T) {
 	defer snap.Cleanup()
 
 	var buf bytes.Buffer
-	if err := CreateArchive(&buf, dir, snap.Overrides, snap.Excludes); err != nil {
+	if _, err := CreateArchive(&buf, dir, snap.Overrides, snap.Excludes, ArchiveOptions{}); err != nil {
 		t.Fatalf("CreateArchive: %v", err)
 	}
 
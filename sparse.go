@@ -0,0 +1,226 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// lseek whence values for hole detection (Linux, also FreeBSD/macOS).
+	seekData = 3
+	seekHole = 4
+
+	// blockSize is the tar record block size.
+	blockSize = 512
+	// sparseBlock is the granularity at which extraction turns zero runs
+	// back into holes.
+	sparseBlock = 4096
+)
+
+// dataSegment is a run of real data inside a sparse file.
+type dataSegment struct {
+	Offset, Length int64
+}
+
+// dataSegments returns the data regions of f, whose size is size, using
+// SEEK_DATA/SEEK_HOLE. ok is false when the file has no holes or the
+// filesystem can't report them, in which case it should be read normally.
+func dataSegments(f *os.File, size int64) (segs []dataSegment, ok bool) {
+	defer f.Seek(0, io.SeekStart)
+
+	var off int64
+	for off < size {
+		start, err := f.Seek(off, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			break // only a hole remains
+		}
+		if err != nil {
+			return nil, false
+		}
+		end, err := f.Seek(start, seekHole)
+		if err != nil {
+			return nil, false
+		}
+		if end > size {
+			end = size
+		}
+		if end > start {
+			segs = append(segs, dataSegment{Offset: start, Length: end - start})
+		}
+		off = end
+	}
+	if len(segs) == 1 && segs[0].Offset == 0 && segs[0].Length == size {
+		return nil, false
+	}
+	// Like GNU tar, mark a trailing hole with an empty segment at EOF so
+	// extractors know to extend the file to its full size.
+	if n := len(segs); n == 0 || segs[n-1].Offset+segs[n-1].Length < size {
+		segs = append(segs, dataSegment{Offset: size})
+	}
+	return segs, true
+}
+
+// writeSparseEntry writes hdr and the data segments of f as a GNU PAX
+// sparse 1.0 entry. tw must have no entry in progress; the raw PAX header
+// is written to w, the stream underneath tw. Returns false without writing
+// anything if hdr can't be expressed this way (e.g. needs PAX itself), so
+// the caller can fall back to a regular entry.
+func writeSparseEntry(tw *tar.Writer, w io.Writer, hdr *tar.Header, f *os.File, segs []dataSegment) (bool, error) {
+	var sparseMap bytes.Buffer
+	fmt.Fprintf(&sparseMap, "%d\n", len(segs))
+	var dataLen int64
+	for _, s := range segs {
+		fmt.Fprintf(&sparseMap, "%d\n%d\n", s.Offset, s.Length)
+		dataLen += s.Length
+	}
+	if pad := sparseMap.Len() % blockSize; pad != 0 {
+		sparseMap.Write(make([]byte, blockSize-pad))
+	}
+
+	// The outer header is plain USTAR; the real name and size travel in
+	// the PAX records.
+	outer := *hdr
+	outer.Name = sparsePlaceholderName(hdr.Name)
+	outer.Size = int64(sparseMap.Len()) + dataLen
+	outer.Format = tar.FormatUSTAR
+	outer.ModTime = hdr.ModTime.Round(time.Second)
+	outer.PAXRecords = nil
+	if err := tar.NewWriter(io.Discard).WriteHeader(&outer); err != nil {
+		return false, nil
+	}
+
+	records := paxRecord("GNU.sparse.major", "1") +
+		paxRecord("GNU.sparse.minor", "0") +
+		paxRecord("GNU.sparse.name", hdr.Name) +
+		paxRecord("GNU.sparse.realsize", strconv.FormatInt(hdr.Size, 10))
+
+	if err := tw.Flush(); err != nil {
+		return true, err
+	}
+	if err := writePAXHeader(w, path.Base(hdr.Name), records); err != nil {
+		return true, err
+	}
+	if err := tw.WriteHeader(&outer); err != nil {
+		return true, err
+	}
+	if _, err := tw.Write(sparseMap.Bytes()); err != nil {
+		return true, err
+	}
+	for _, s := range segs {
+		if _, err := f.Seek(s.Offset, io.SeekStart); err != nil {
+			return true, err
+		}
+		if _, err := io.CopyN(tw, f, s.Length); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// isSparseHeader reports whether hdr was read from a GNU sparse entry.
+func isSparseHeader(hdr *tar.Header) bool {
+	_, ok := hdr.PAXRecords["GNU.sparse.major"]
+	if !ok {
+		_, ok = hdr.PAXRecords["GNU.sparse.map"]
+	}
+	return ok
+}
+
+// copySparse copies size bytes from r to f, seeking over zero blocks
+// instead of writing them so the holes of a sparse file are recreated.
+func copySparse(f *os.File, r io.Reader, size int64) error {
+	buf := make([]byte, 16*sparseBlock)
+	zero := make([]byte, sparseBlock)
+	var written int64
+	for written < size {
+		n, err := io.ReadFull(r, buf[:min(int64(len(buf)), size-written)])
+		for off := 0; off < n; off += sparseBlock {
+			chunk := buf[off:min(off+sparseBlock, n)]
+			if bytes.Equal(chunk, zero[:len(chunk)]) {
+				if _, err := f.Seek(int64(len(chunk)), io.SeekCurrent); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := f.Write(chunk); err != nil {
+				return err
+			}
+		}
+		written += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return f.Truncate(size)
+}
+
+// sparsePlaceholderName mirrors GNU tar's naming for the outer header of a
+// sparse entry; readers that understand the PAX records use the real name.
+func sparsePlaceholderName(name string) string {
+	p := path.Join(path.Dir(name), "GNUSparseFile.0", path.Base(name))
+	if len(p) > 100 {
+		p = "GNUSparseFile.0/" + path.Base(name)
+	}
+	if len(p) > 100 {
+		p = p[:100]
+	}
+	return p
+}
+
+// paxRecord formats one "<len> key=value\n" PAX record, where len counts
+// the whole record including itself.
+func paxRecord(k, v string) string {
+	const padding = 3 // extra space, '=' and '\n'
+	size := len(k) + len(v) + padding
+	size += len(strconv.Itoa(size))
+	rec := strconv.Itoa(size) + " " + k + "=" + v + "\n"
+	if len(rec) != size {
+		size = len(rec)
+		rec = strconv.Itoa(size) + " " + k + "=" + v + "\n"
+	}
+	return rec
+}
+
+// writePAXHeader writes a typeflag 'x' header block followed by records,
+// padded to the block size.
+func writePAXHeader(w io.Writer, base, records string) error {
+	var blk [blockSize]byte
+	name := "PaxHeaders.0/" + base
+	if len(name) > 100 {
+		name = name[:100]
+	}
+	copy(blk[0:100], name)
+	copy(blk[100:108], "0000644\x00")
+	copy(blk[108:116], "0000000\x00")
+	copy(blk[116:124], "0000000\x00")
+	copy(blk[124:136], fmt.Sprintf("%011o\x00", len(records)))
+	copy(blk[136:148], "00000000000\x00")
+	blk[156] = tar.TypeXHeader
+	copy(blk[257:265], "ustar\x0000")
+
+	// The checksum is computed with its own field filled with spaces.
+	copy(blk[148:156], "        ")
+	var sum int64
+	for _, b := range blk {
+		sum += int64(b)
+	}
+	copy(blk[148:156], fmt.Sprintf("%06o\x00 ", sum))
+
+	if _, err := w.Write(blk[:]); err != nil {
+		return err
+	}
+	data := []byte(records)
+	if pad := len(data) % blockSize; pad != 0 {
+		data = append(data, make([]byte, blockSize-pad)...)
+	}
+	_, err := w.Write(data)
+	return err
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// makeSparseFile creates a 1 MiB file with 4 KiB of data in the middle.
+func makeSparseFile(t *testing.T, path string) []byte {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	defer f.Close()
+	if err := f.Truncate(1 << 20); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	data := bytes.Repeat([]byte("sparse!\n"), 512)
+	if _, err := f.WriteAt(data, 512<<10); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	want := make([]byte, 1<<20)
+	copy(want[512<<10:], data)
+	return want
+}
+
+func TestSparseArchiveRoundTrip(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "data")
+	os.MkdirAll(dir, 0755)
+	want := makeSparseFile(t, filepath.Join(dir, "disk.img"))
+	os.WriteFile(filepath.Join(dir, "after.txt"), []byte("after"), 0644)
+
+	f, _ := os.Open(filepath.Join(dir, "disk.img"))
+	_, holes := dataSegments(f, int64(len(want)))
+	f.Close()
+	if !holes {
+		t.Skip("filesystem does not report holes")
+	}
+
+	var buf bytes.Buffer
+	if _, err := CreateArchive(&buf, dir, nil, nil, ArchiveOptions{Sparse: true}); err != nil {
+		t.Fatalf("CreateArchive: %v", err)
+	}
+	// The holes should not have been stored: the archive would otherwise
+	// hold a full MiB of (well compressed) zeros before gzip.
+	raw, _ := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+	rawTar, _ := io.ReadAll(raw)
+	if len(rawTar) > 64<<10 {
+		t.Errorf("uncompressed archive is %d bytes, expected holes to be omitted", len(rawTar))
+	}
+
+	gr, err := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	tr := tar.NewReader(gr)
+	contents := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tar: %v", err)
+		}
+		data, _ := io.ReadAll(tr)
+		contents[hdr.Name] = data
+		if hdr.Name == "data/disk.img" && !isSparseHeader(hdr) {
+			t.Error("data/disk.img was not stored as a sparse entry")
+		}
+	}
+	if !bytes.Equal(contents["data/disk.img"], want) {
+		t.Error("data/disk.img content mismatch after round trip")
+	}
+	if string(contents["data/after.txt"]) != "after" {
+		t.Errorf("data/after.txt = %q, want %q", contents["data/after.txt"], "after")
+	}
+
+	dest := t.TempDir()
+	if err := ExtractArchive(bytes.NewReader(buf.Bytes()), dest, ExtractOptions{}); err != nil {
+		t.Fatalf("ExtractArchive: %v", err)
+	}
+	restored := filepath.Join(dest, "data", "disk.img")
+	got, err := os.ReadFile(restored)
+	if err != nil {
+		t.Fatalf("reading restored file: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("restored disk.img content mismatch")
+	}
+	fi, _ := os.Stat(restored)
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Blocks*512 >= int64(len(want)) {
+		t.Errorf("restored disk.img uses %d bytes on disk, expected holes", st.Blocks*512)
+	}
+}
+
+func TestSparseDisabledStoresFullFile(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "data")
+	os.MkdirAll(dir, 0755)
+	want := makeSparseFile(t, filepath.Join(dir, "disk.img"))
+
+	var buf bytes.Buffer
+	if _, err := CreateArchive(&buf, dir, nil, nil, ArchiveOptions{}); err != nil {
+		t.Fatalf("CreateArchive: %v", err)
+	}
+	gr, _ := gzip.NewReader(&buf)
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tar: %v", err)
+		}
+		if hdr.Name != "data/disk.img" {
+			continue
+		}
+		if isSparseHeader(hdr) {
+			t.Error("disk.img stored as sparse without the sparse option")
+		}
+		data, _ := io.ReadAll(tr)
+		if !bytes.Equal(data, want) {
+			t.Error("disk.img content mismatch")
+		}
+	}
+}
+
+func TestSparseWithChangeRetries(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "data")
+	os.MkdirAll(dir, 0755)
+	want := makeSparseFile(t, filepath.Join(dir, "disk.img"))
+
+	f, _ := os.Open(filepath.Join(dir, "disk.img"))
+	_, holes := dataSegments(f, int64(len(want)))
+	f.Close()
+	if !holes {
+		t.Skip("filesystem does not report holes")
+	}
+
+	// A sparse file that isn't being written to is checked for changes
+	// and still stored sparse.
+	var buf bytes.Buffer
+	report, err := CreateArchive(&buf, dir, nil, nil, ArchiveOptions{Sparse: true, ChangeRetries: 2})
+	if err != nil {
+		t.Fatalf("CreateArchive: %v", err)
+	}
+	if len(report.Changed) != 0 {
+		t.Errorf("Changed = %v, want none", report.Changed)
+	}
+	gr, _ := gzip.NewReader(&buf)
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tar: %v", err)
+		}
+		if hdr.Name != "data/disk.img" {
+			continue
+		}
+		if !isSparseHeader(hdr) {
+			t.Error("disk.img not stored as sparse with change retries")
+		}
+		data, _ := io.ReadAll(tr)
+		if !bytes.Equal(data, want) {
+			t.Error("disk.img content mismatch")
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateVersion is the version of the state file format this build writes.
+const stateVersion = 1
+
+// State file names, both kept next to the config file.
+const (
+	stateFileName     = "state.json"
+	checksumsFileName = "checksums.json" // the slug->hash map used before state.json
+)
+
+// State is what pi-backup remembers between runs, keyed by source slug
+// (see PathSlug).
+type State struct {
+	Version int                     `json:"version"`
+	Sources map[string]*SourceState `json:"sources"`
+}
+
+// SourceState records the last backup of one directory or command source.
+// The hash, key, size, upload time and duration describe the last archive
+// that was uploaded; LastSuccess also moves on runs that skipped an
+// unchanged archive. Fingerprint is the directory's tree fingerprint as of
+// CheckedAt, the last time it was archived in full. LastFailure and
+// LastError keep the most recent failure even after later successes.
+type SourceState struct {
+	Source      string    `json:"source,omitempty"` // directory path or command source ID
+	Hash        string    `json:"hash,omitempty"`
+	Key         string    `json:"key,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	UploadedAt  time.Time `json:"uploaded_at,omitzero"`
+	Duration    float64   `json:"duration_seconds,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"` // see TreeFingerprint
+	CheckedAt   time.Time `json:"checked_at,omitzero"`   // last full archive and hash comparison
+	LastSuccess time.Time `json:"last_success,omitzero"`
+	LastFailure time.Time `json:"last_failure,omitzero"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// StatePath returns the path of the state file for the config at
+// configPath.
+func StatePath(configPath string) string {
+	return filepath.Join(filepath.Dir(configPath), stateFileName)
+}
+
+// LoadState reads the state file at path. If it doesn't exist, hashes are
+// migrated from a checksums.json in the same directory, and if that doesn't
+// exist either an empty state is returned.
+func LoadState(path string) (*State, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return migrateChecksums(filepath.Join(filepath.Dir(path), checksumsFileName))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var s State
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if s.Version > stateVersion {
+		return nil, fmt.Errorf("%s is version %d, written by a newer pi-backup (this one reads up to %d)", path, s.Version, stateVersion)
+	}
+	if s.Sources == nil {
+		s.Sources = map[string]*SourceState{}
+	}
+	s.Version = stateVersion
+	return &s, nil
+}
+
+// migrateChecksums builds a state from the slug->hash map in the legacy
+// checksums.json at path. The file is left in place; once state.json has
+// been written it is no longer read.
+func migrateChecksums(path string) (*State, error) {
+	s := &State{Version: stateVersion, Sources: map[string]*SourceState{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var m map[string]string
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for slug, hash := range m {
+		s.Sources[slug] = &SourceState{Hash: hash}
+	}
+	log.Printf("migrated %d entries from %s", len(m), path)
+	return s, nil
+}
+
+// Source returns the state for the source with the given ID, creating it
+// if needed.
+func (s *State) Source(id string) *SourceState {
+	slug := PathSlug(id)
+	ss, ok := s.Sources[slug]
+	if !ok {
+		ss = &SourceState{}
+		s.Sources[slug] = ss
+	}
+	ss.Source = id
+	return ss
+}
+
+// Save writes s to path atomically, so a power cut leaves either the old
+// or the new file, never a truncated one.
+func (s *State) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'), 0644)
+}
+
+// writeFileAtomic writes data to a temp file next to path, fsyncs it,
+// renames it over path and fsyncs the directory.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp) // no-op once renamed
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
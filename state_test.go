@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadStateMissingFile(t *testing.T) {
+	s, err := LoadState(filepath.Join(t.TempDir(), stateFileName))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.Version != stateVersion || len(s.Sources) != 0 {
+		t.Errorf("expected empty state, got %+v", s)
+	}
+}
+
+func TestSaveAndLoadState(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, stateFileName)
+
+	now := time.Date(2026, 2, 11, 3, 0, 0, 0, time.UTC)
+	s := &State{Version: stateVersion, Sources: map[string]*SourceState{}}
+	ss := s.Source("/opt/homeassistant/config")
+	ss.Hash = "abc123"
+	ss.Key = S3Key("cherry", "/opt/homeassistant/config", now)
+	ss.Size = 4096
+	ss.UploadedAt = now
+	ss.Duration = 1.5
+	ss.LastSuccess = now
+	fail := s.Source("cmd:sys")
+	fail.LastFailure = now
+	fail.LastError = "boom"
+
+	if err := s.Save(path); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("expected only %s in dir, got %v", stateFileName, entries)
+	}
+
+	loaded, err := LoadState(path)
+	if err != nil {
+		t.Fatalf("LoadState: %v", err)
+	}
+	got := loaded.Sources["opt-homeassistant-config"]
+	if got == nil || *got != *ss {
+		t.Errorf("got %+v, want %+v", got, ss)
+	}
+	if got := loaded.Sources["cmd-sys"]; got == nil || *got != *fail {
+		t.Errorf("got %+v, want %+v", got, fail)
+	}
+}
+
+func TestLoadStateMigratesChecksums(t *testing.T) {
+	dir := t.TempDir()
+	legacy := `{"opt-pi-backup-test-data": "abc123", "opt-homeassistant-config": "def456"}`
+	os.WriteFile(filepath.Join(dir, checksumsFileName), []byte(legacy), 0644)
+
+	s, err := LoadState(filepath.Join(dir, stateFileName))
+	if err != nil {
+		t.Fatalf("LoadState: %v", err)
+	}
+	if len(s.Sources) != 2 {
+		t.Fatalf("got %d sources, want 2", len(s.Sources))
+	}
+	if got := s.Sources["opt-homeassistant-config"].Hash; got != "def456" {
+		t.Errorf("hash = %q, want def456", got)
+	}
+}
+
+func TestLoadStateIgnoresChecksumsOnceWritten(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, stateFileName)
+	os.WriteFile(filepath.Join(dir, checksumsFileName), []byte(`{"old": "x"}`), 0644)
+	if err := (&State{Version: stateVersion, Sources: map[string]*SourceState{}}).Save(path); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	s, err := LoadState(path)
+	if err != nil {
+		t.Fatalf("LoadState: %v", err)
+	}
+	if len(s.Sources) != 0 {
+		t.Errorf("checksums.json read despite state.json: %+v", s.Sources)
+	}
+}
+
+func TestLoadStateNewerVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), stateFileName)
+	os.WriteFile(path, []byte(`{"version": 99, "sources": {}}`), 0644)
+
+	_, err := LoadState(path)
+	if err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Fatalf("err = %v, want newer-version error", err)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Suffixes of the directories a swap restore leaves next to its target.
+const (
+	preRestoreSuffix = ".pre-restore-" // the live directory, moved aside
+	rolledBackSuffix = ".rolled-back-" // a restored directory undone by --rollback
+)
+
+// SwapRestore restores the archive at key over a live directory without
+// ever leaving a mix of old and new files. The archive is downloaded and
+// extracted with opts into a staging directory inside destDir, its
+// top-level directory is checked with verify (if set), the live directory
+// destDir/<name> is renamed aside to <name>.pre-restore-<ts>, and the
+// restored tree is renamed into its place.
+//
+// It returns the restored directory and the path the live one was moved
+// to, which is empty if there was no live directory. If anything fails
+// before the swap, the live directory is untouched.
+func SwapRestore(ctx context.Context, cfg *Config, key, destDir string, opts ExtractOptions, verify func(root string) error) (target, aside string, err error) {
+	return swapRestore(destDir, func(staging string) error {
+		// A failed checksum fails here, before the swap, so the staged
+		// tree is simply discarded.
+		return restoreStream(ctx, cfg, key, staging, opts)
+	}, verify)
+}
+
+// swapRestore is SwapRestore with the download and extraction into the
+// staging directory done by extract.
+func swapRestore(destDir string, extract func(staging string) error, verify func(root string) error) (target, aside string, err error) {
+	ts := time.Now().UTC().Format(snapshotTimeFormat)
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return "", "", fmt.Errorf("creating %s: %w", destDir, err)
+	}
+	staging, err := os.MkdirTemp(destDir, ".pi-backup-restore-*")
+	if err != nil {
+		return "", "", fmt.Errorf("creating staging dir: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	if err := extract(staging); err != nil {
+		return "", "", err
+	}
+
+	root, err := stagedRoot(staging)
+	if err != nil {
+		return "", "", err
+	}
+	if verify != nil {
+		if err := verify(root); err != nil {
+			return "", "", fmt.Errorf("verifying restored tree: %w", err)
+		}
+	}
+
+	target = filepath.Join(destDir, filepath.Base(root))
+	if _, err := os.Lstat(target); err == nil {
+		aside = target + preRestoreSuffix + ts
+		if err := os.Rename(target, aside); err != nil {
+			return "", "", fmt.Errorf("moving %s aside: %w", target, err)
+		}
+		log.Printf("moved %s to %s", target, aside)
+	} else if !os.IsNotExist(err) {
+		return "", "", err
+	}
+
+	if err := os.Rename(root, target); err != nil {
+		if aside != "" {
+			if rerr := os.Rename(aside, target); rerr != nil {
+				return "", aside, fmt.Errorf("swapping in restored tree: %w (and moving %s back failed: %v)", err, aside, rerr)
+			}
+		}
+		return "", "", fmt.Errorf("swapping in restored tree: %w", err)
+	}
+	return target, aside, nil
+}
+
+// stagedRoot returns the single top-level directory an archive extracted
+// into staging.
+func stagedRoot(staging string) (string, error) {
+	entries, err := os.ReadDir(staging)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) != 1 || !entries[0].IsDir() {
+		return "", fmt.Errorf("archive doesn't hold a single top-level directory")
+	}
+	return filepath.Join(staging, entries[0].Name()), nil
+}
+
+// verifyRestored checks a restored copy of d: each declared SQLite
+// database that was restored must pass PRAGMA integrity_check.
+func verifyRestored(d Directory) func(root string) error {
+	return func(root string) error {
+		for _, rel := range d.SqliteFiles {
+			p := filepath.Join(root, rel)
+			if _, err := os.Stat(p); os.IsNotExist(err) {
+				continue
+			}
+			if err := checkSqliteIntegrity(p); err != nil {
+				return fmt.Errorf("%s: %w", rel, err)
+			}
+		}
+		return nil
+	}
+}
+
+// RollbackRestore undoes the most recent swap restore of target: target
+// is moved aside to <target>.rolled-back-<ts> and the newest
+// <target>.pre-restore-<ts> is renamed back into its place. It returns the
+// path the restored directory was moved to.
+func RollbackRestore(target string) (string, error) {
+	previous, err := latestPreRestore(target)
+	if err != nil {
+		return "", err
+	}
+
+	ts := time.Now().UTC().Format(snapshotTimeFormat)
+	undone := target + rolledBackSuffix + ts
+	if err := os.Rename(target, undone); os.IsNotExist(err) {
+		undone = ""
+	} else if err != nil {
+		return "", fmt.Errorf("moving %s aside: %w", target, err)
+	}
+	if err := os.Rename(previous, target); err != nil {
+		if undone != "" {
+			os.Rename(undone, target)
+		}
+		return "", fmt.Errorf("moving %s back: %w", previous, err)
+	}
+	log.Printf("moved %s back to %s", previous, target)
+	return undone, nil
+}
+
+// latestPreRestore returns the newest <target>.pre-restore-<ts> directory.
+func latestPreRestore(target string) (string, error) {
+	matches, err := filepath.Glob(target + preRestoreSuffix + "*")
+	if err != nil {
+		return "", err
+	}
+	var candidates []string
+	for _, m := range matches {
+		ts := strings.TrimPrefix(m, target+preRestoreSuffix)
+		if _, err := time.Parse(snapshotTimeFormat, ts); err == nil {
+			candidates = append(candidates, m)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no %s%s* directory to roll back to", target, preRestoreSuffix)
+	}
+	// Timestamps sort lexically.
+	sort.Strings(candidates)
+	return candidates[len(candidates)-1], nil
+}
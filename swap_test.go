@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// archiveOf returns an extract func for swapRestore that extracts a fresh
+// archive of dir with opts.
+func archiveOf(t *testing.T, dir string, opts ExtractOptions) func(staging string) error {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := CreateArchive(&buf, dir, nil, nil, ArchiveOptions{}); err != nil {
+		t.Fatalf("CreateArchive: %v", err)
+	}
+	return func(staging string) error {
+		return ExtractArchive(bytes.NewReader(buf.Bytes()), staging, opts)
+	}
+}
+
+func TestSwapRestore(t *testing.T) {
+	// The backup has keep.txt; since then the live copy gained new.txt and
+	// keep.txt was changed.
+	src := filepath.Join(t.TempDir(), "mydata")
+	os.MkdirAll(src, 0755)
+	os.WriteFile(filepath.Join(src, "keep.txt"), []byte("backed up"), 0644)
+	extract := archiveOf(t, src, ExtractOptions{})
+
+	dest := t.TempDir()
+	live := filepath.Join(dest, "mydata")
+	os.MkdirAll(live, 0755)
+	os.WriteFile(filepath.Join(live, "keep.txt"), []byte("edited"), 0644)
+	os.WriteFile(filepath.Join(live, "new.txt"), []byte("new"), 0644)
+
+	target, aside, err := swapRestore(dest, extract, nil)
+	if err != nil {
+		t.Fatalf("swapRestore: %v", err)
+	}
+	if target != live {
+		t.Errorf("target = %s, want %s", target, live)
+	}
+	if got, _ := os.ReadFile(filepath.Join(live, "keep.txt")); string(got) != "backed up" {
+		t.Errorf("keep.txt = %q, want the backed-up contents", got)
+	}
+	if _, err := os.Stat(filepath.Join(live, "new.txt")); !os.IsNotExist(err) {
+		t.Error("new.txt survived a swap restore")
+	}
+	if got, _ := os.ReadFile(filepath.Join(aside, "new.txt")); string(got) != "new" {
+		t.Errorf("previous tree not kept at %s", aside)
+	}
+
+	// Only the restored dir and the pre-restore copy are left; no staging.
+	entries, _ := os.ReadDir(dest)
+	if len(entries) != 2 {
+		t.Errorf("dest holds %v, want the restored and pre-restore dirs", entries)
+	}
+
+	undone, err := RollbackRestore(live)
+	if err != nil {
+		t.Fatalf("RollbackRestore: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(live, "keep.txt")); string(got) != "edited" {
+		t.Errorf("after rollback keep.txt = %q, want %q", got, "edited")
+	}
+	if got, _ := os.ReadFile(filepath.Join(undone, "keep.txt")); string(got) != "backed up" {
+		t.Errorf("rolled-back restore not kept at %s", undone)
+	}
+	if _, err := os.Stat(aside); !os.IsNotExist(err) {
+		t.Errorf("%s still exists after rollback", aside)
+	}
+}
+
+func TestSwapRestoreVerifyFailureLeavesLiveDir(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "mydata")
+	os.MkdirAll(src, 0755)
+	os.WriteFile(filepath.Join(src, "a.txt"), []byte("backed up"), 0644)
+	extract := archiveOf(t, src, ExtractOptions{})
+
+	dest := t.TempDir()
+	live := filepath.Join(dest, "mydata")
+	os.MkdirAll(live, 0755)
+	os.WriteFile(filepath.Join(live, "a.txt"), []byte("live"), 0644)
+
+	_, _, err := swapRestore(dest, extract, func(string) error { return errors.New("corrupt") })
+	if err == nil {
+		t.Fatal("expected verify error")
+	}
+	if got, _ := os.ReadFile(filepath.Join(live, "a.txt")); string(got) != "live" {
+		t.Errorf("live a.txt = %q after a failed restore", got)
+	}
+	entries, _ := os.ReadDir(dest)
+	if len(entries) != 1 {
+		t.Errorf("dest holds %v, want only the live dir", entries)
+	}
+}
+
+func TestSwapRestoreLimitLeavesLiveDir(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "mydata")
+	os.MkdirAll(src, 0755)
+	os.WriteFile(filepath.Join(src, "a.txt"), []byte("backed up"), 0644)
+	os.WriteFile(filepath.Join(src, "b.txt"), []byte("backed up"), 0644)
+
+	dest := t.TempDir()
+	live := filepath.Join(dest, "mydata")
+	os.MkdirAll(live, 0755)
+	os.WriteFile(filepath.Join(live, "a.txt"), []byte("live"), 0644)
+
+	// As with restore --swap --max-entries 2: the directory and two files
+	// are one entry too many.
+	_, _, err := swapRestore(dest, archiveOf(t, src, ExtractOptions{MaxEntries: 2}), nil)
+	if err == nil || !strings.Contains(err.Error(), "more than 2 entries") {
+		t.Fatalf("err = %v, want the entry limit", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(live, "a.txt")); string(got) != "live" {
+		t.Errorf("live a.txt = %q after a failed restore", got)
+	}
+	entries, _ := os.ReadDir(dest)
+	if len(entries) != 1 {
+		t.Errorf("dest holds %v, want only the live dir", entries)
+	}
+}
+
+func TestSwapRestoreNoLiveDir(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "mydata")
+	os.MkdirAll(src, 0755)
+	os.WriteFile(filepath.Join(src, "a.txt"), []byte("backed up"), 0644)
+
+	dest := t.TempDir()
+	target, aside, err := swapRestore(dest, archiveOf(t, src, ExtractOptions{}), nil)
+	if err != nil {
+		t.Fatalf("swapRestore: %v", err)
+	}
+	if aside != "" {
+		t.Errorf("aside = %q with no live dir", aside)
+	}
+	if got, _ := os.ReadFile(filepath.Join(target, "a.txt")); string(got) != "backed up" {
+		t.Errorf("a.txt = %q", got)
+	}
+}
+
+func TestRollbackRestoreWithoutPreRestore(t *testing.T) {
+	if _, err := RollbackRestore(filepath.Join(t.TempDir(), "mydata")); err == nil {
+		t.Fatal("expected error with nothing to roll back to")
+	}
+}
+
+func TestVerifyRestoredSqlite(t *testing.T) {
+	root := t.TempDir()
+	makeSqliteDB(t, filepath.Join(root, "good.db"))
+	os.WriteFile(filepath.Join(root, "bad.db"), append([]byte(sqliteHeader), make([]byte, 4096)...), 0644)
+
+	if err := verifyRestored(Directory{SqliteFiles: []string{"good.db", "missing.db"}})(root); err != nil {
+		t.Errorf("verify good db: %v", err)
+	}
+	if err := verifyRestored(Directory{SqliteFiles: []string{"bad.db"}})(root); err == nil {
+		t.Error("verify accepted a corrupt db")
+	}
+}
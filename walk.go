@@ -0,0 +1,170 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// ArchiveOptions controls how CreateArchive walks and stores a directory.
+// The zero value matches plain filepath.Walk semantics: mount points are
+// crossed, symlinks are stored as links, files are read in full and any
+// error aborts the archive.
+type ArchiveOptions struct {
+	// OneFileSystem stops the walk from descending into directories that
+	// live on a different device than the root. The mount point itself is
+	// still archived (as an empty directory), like `tar --one-file-system`.
+	OneFileSystem bool
+	// FollowSymlinks archives what symlinks point at instead of the links.
+	// Links that would loop back into one of their own ancestors, and
+	// dangling links, are stored as plain symlinks.
+	FollowSymlinks bool
+	// Sparse stores files with holes as PAX sparse entries so the holes are
+	// neither read nor written out as runs of zeros.
+	Sparse bool
+	// SkipErrors leaves entries that can't be read (permission denied, I/O
+	// errors, files deleted mid-walk) out of the archive and reports them
+	// instead of failing the whole archive.
+	SkipErrors bool
+	// ChangeRetries is how many times to re-read a file that changes while
+	// it is being read. When non-zero, each file is read through once
+	// first, and one that changed is staged in a temporary spool until a
+	// consistent copy can be archived; other files, and all files when
+	// zero, are streamed straight into the archive and changes are only
+	// reported.
+	ChangeRetries int
+}
+
+// fileKey identifies a file by device and inode.
+type fileKey struct {
+	dev, ino uint64
+}
+
+// statKey extracts the device/inode pair from info. ok is false when the
+// platform doesn't expose them.
+func statKey(info os.FileInfo) (key fileKey, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileKey{}, false
+	}
+	return fileKey{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
+
+// walkTree walks the tree rooted at root in lexical order, calling fn for
+// every entry, honouring opts. It follows the filepath.Walk contract: fn
+// may return filepath.SkipDir to skip a directory, and is called with a
+// non-nil err when an entry can't be stat'ed or a directory can't be read.
+func walkTree(root string, opts ArchiveOptions, fn filepath.WalkFunc) error {
+	info, err := os.Lstat(root)
+	if err == nil && opts.FollowSymlinks && info.Mode()&os.ModeSymlink != 0 {
+		if target, serr := os.Stat(root); serr == nil {
+			info = target
+		}
+	}
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		w := &treeWalker{opts: opts, fn: fn, ancestors: map[fileKey]bool{}}
+		if key, ok := statKey(info); ok {
+			w.rootDev = key.dev
+		}
+		err = w.walk(root, info)
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+type treeWalker struct {
+	opts      ArchiveOptions
+	fn        filepath.WalkFunc
+	rootDev   uint64
+	ancestors map[fileKey]bool // directories on the current path
+}
+
+func (w *treeWalker) walk(path string, info os.FileInfo) error {
+	if !info.IsDir() {
+		return w.fn(path, info, nil)
+	}
+
+	if err := w.fn(path, info, nil); err != nil {
+		return err
+	}
+
+	key, hasKey := statKey(info)
+	if w.opts.OneFileSystem && hasKey && key.dev != w.rootDev {
+		return nil
+	}
+	if hasKey {
+		w.ancestors[key] = true
+		defer delete(w.ancestors, key)
+	}
+
+	names, err := readDirNames(path)
+	if err != nil {
+		// Give fn a second look at the directory, as filepath.Walk does.
+		if err := w.fn(path, info, err); err != nil {
+			if err == filepath.SkipDir {
+				return nil
+			}
+			return err
+		}
+	}
+
+	for _, name := range names {
+		child := filepath.Join(path, name)
+		ci, err := w.lstat(child)
+		if err != nil {
+			if err := w.fn(child, nil, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+		if err := w.walk(child, ci); err != nil {
+			if err == filepath.SkipDir && ci.IsDir() {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// lstat returns the info to archive for path: the link itself, or its
+// target when following symlinks and the target is safe to descend into.
+func (w *treeWalker) lstat(path string) (os.FileInfo, error) {
+	info, err := os.Lstat(path)
+	if err != nil || !w.opts.FollowSymlinks || info.Mode()&os.ModeSymlink == 0 {
+		return info, err
+	}
+	target, err := os.Stat(path)
+	if err != nil {
+		// Dangling link: keep it as a link.
+		return info, nil
+	}
+	if target.IsDir() {
+		if key, ok := statKey(target); ok && w.ancestors[key] {
+			log.Printf("warning: %s loops back to an ancestor directory; storing as symlink", path)
+			return info, nil
+		}
+	}
+	return target, nil
+}
+
+// readDirNames returns the sorted entry names of dir.
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
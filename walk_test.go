@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// walkNames returns the paths visited by walkTree relative to root's parent.
+func walkNames(t *testing.T, root string, opts ArchiveOptions) map[string]os.FileMode {
+	t.Helper()
+	got := map[string]os.FileMode{}
+	err := walkTree(root, opts, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(filepath.Dir(root), path)
+		got[rel] = info.Mode()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walkTree: %v", err)
+	}
+	return got
+}
+
+func TestWalkTreeKeepsSymlinksByDefault(t *testing.T) {
+	parent := t.TempDir()
+	outside := filepath.Join(parent, "outside")
+	os.MkdirAll(outside, 0755)
+	os.WriteFile(filepath.Join(outside, "x.txt"), []byte("x"), 0644)
+
+	root := filepath.Join(parent, "root")
+	os.MkdirAll(root, 0755)
+	os.Symlink(outside, filepath.Join(root, "link"))
+
+	got := walkNames(t, root, ArchiveOptions{})
+	if got["root/link"]&os.ModeSymlink == 0 {
+		t.Errorf("root/link mode = %v, want symlink", got["root/link"])
+	}
+	if _, ok := got["root/link/x.txt"]; ok {
+		t.Error("walk descended into symlinked directory without follow_symlinks")
+	}
+}
+
+func TestWalkTreeFollowSymlinks(t *testing.T) {
+	parent := t.TempDir()
+	outside := filepath.Join(parent, "outside")
+	os.MkdirAll(outside, 0755)
+	os.WriteFile(filepath.Join(outside, "x.txt"), []byte("x"), 0644)
+
+	root := filepath.Join(parent, "root")
+	os.MkdirAll(root, 0755)
+	os.WriteFile(filepath.Join(root, "real.txt"), []byte("r"), 0644)
+	os.Symlink(outside, filepath.Join(root, "dirlink"))
+	os.Symlink(filepath.Join(root, "real.txt"), filepath.Join(root, "filelink"))
+	os.Symlink(filepath.Join(parent, "missing"), filepath.Join(root, "dangling"))
+
+	got := walkNames(t, root, ArchiveOptions{FollowSymlinks: true})
+	if !got["root/dirlink"].IsDir() {
+		t.Errorf("root/dirlink mode = %v, want directory", got["root/dirlink"])
+	}
+	if _, ok := got["root/dirlink/x.txt"]; !ok {
+		t.Errorf("expected root/dirlink/x.txt; have %v", got)
+	}
+	if !got["root/filelink"].IsRegular() {
+		t.Errorf("root/filelink mode = %v, want regular file", got["root/filelink"])
+	}
+	if got["root/dangling"]&os.ModeSymlink == 0 {
+		t.Errorf("root/dangling mode = %v, want symlink", got["root/dangling"])
+	}
+}
+
+func TestWalkTreeFollowSymlinksLoop(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	os.MkdirAll(filepath.Join(root, "sub"), 0755)
+	os.Symlink(root, filepath.Join(root, "sub", "up"))
+
+	got := walkNames(t, root, ArchiveOptions{FollowSymlinks: true})
+	if got["root/sub/up"]&os.ModeSymlink == 0 {
+		t.Errorf("root/sub/up mode = %v, want symlink (loop)", got["root/sub/up"])
+	}
+	if _, ok := got["root/sub/up/sub"]; ok {
+		t.Error("walk followed a symlink loop")
+	}
+}